@@ -0,0 +1,342 @@
+// Package broker holds the RabbitMQ connection and consumer setup shared by the
+// Go services.
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type Config struct {
+	Username string
+	Password string
+	Host     string
+	Port     string
+	// Vhost is the virtual host, "/" (the default vhost) when empty.
+	Vhost string
+
+	// RawURL is RABBITMQ_URL, dialed as is instead of the URL built from the
+	// fields above when set.
+	RawURL string
+}
+
+type ConsumeOptions struct {
+	Tag        string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Prefetch   int
+
+	// ManualAck leaves acknowledging each delivery to the consumer. Otherwise
+	// the broker considers a delivery acked as soon as it is sent.
+	ManualAck bool
+
+	// QueueArgs, when set, returns the arguments each queue is declared with
+	// (e.g. x-dead-letter-exchange).
+	QueueArgs func(queue string) amqp.Table
+}
+
+// Channel is the subset of *amqp.Channel used to register consumers.
+type Channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+}
+
+// ConfigFromEnv reads RABBITMQ_URL, or the RABBITMQ_USERNAME,
+// RABBITMQ_PASSWORD, RABBITMQ_HOST, RABBITMQ_PORT and RABBITMQ_VHOST it
+// replaces when unset.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Username: os.Getenv("RABBITMQ_USERNAME"),
+		Password: os.Getenv("RABBITMQ_PASSWORD"),
+		Host:     os.Getenv("RABBITMQ_HOST"),
+		Port:     os.Getenv("RABBITMQ_PORT"),
+		Vhost:    os.Getenv("RABBITMQ_VHOST"),
+		RawURL:   os.Getenv("RABBITMQ_URL"),
+	}
+
+	if cfg.RawURL != "" {
+		if _, err := amqp.ParseURI(cfg.RawURL); err != nil {
+			return Config{}, fmt.Errorf("invalid RABBITMQ_URL: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ConsumeOptionsFromEnv reads the CONSUMER_TAG, QUEUE_DURABLE,
+// QUEUE_AUTO_DELETE, QUEUE_EXCLUSIVE and PREFETCH_COUNT settings. Unset ones
+// keep the values given in defaults.
+func ConsumeOptionsFromEnv(defaults ConsumeOptions) (ConsumeOptions, error) {
+	opts := defaults
+	if tag := os.Getenv("CONSUMER_TAG"); tag != "" {
+		opts.Tag = tag
+	}
+
+	var err error
+	if opts.Durable, err = envBool("QUEUE_DURABLE", defaults.Durable); err != nil {
+		return ConsumeOptions{}, err
+	}
+
+	if opts.AutoDelete, err = envBool("QUEUE_AUTO_DELETE", defaults.AutoDelete); err != nil {
+		return ConsumeOptions{}, err
+	}
+
+	if opts.Exclusive, err = envBool("QUEUE_EXCLUSIVE", defaults.Exclusive); err != nil {
+		return ConsumeOptions{}, err
+	}
+
+	if opts.Prefetch, err = envInt("PREFETCH_COUNT", defaults.Prefetch); err != nil {
+		return ConsumeOptions{}, err
+	}
+
+	if opts.Prefetch < 0 {
+		return ConsumeOptions{}, fmt.Errorf("invalid PREFETCH_COUNT \"%d\": must not be negative", opts.Prefetch)
+	}
+
+	return opts, nil
+}
+
+// DefaultConsumerTag returns "<prefix>-<hostname>-<pid>", so replicas sharing
+// a queue can be told apart in the management UI.
+func DefaultConsumerTag(prefix string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%s-%d", prefix, hostname, os.Getpid())
+}
+
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return i, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\": must be greater than zero", name, value)
+	}
+
+	return d, nil
+}
+
+func envFloat(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return f, nil
+}
+
+func envBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+func (c Config) URL() string {
+	if c.RawURL != "" {
+		return c.RawURL
+	}
+
+	return fmt.Sprintf("amqp://%s:%s@%s:%s/%s", c.Username, c.Password, c.Host, c.Port, c.vhostPath())
+}
+
+// RedactedURL is URL with the password replaced by "****", for anything that
+// ends up in logs.
+func (c Config) RedactedURL() string {
+	if c.RawURL != "" {
+		return redactURL(c.RawURL)
+	}
+
+	return fmt.Sprintf("amqp://%s:%s@%s:%s/%s", c.Username, redacted, c.Host, c.Port, c.vhostPath())
+}
+
+// vhostPath is the vhost as the path segment of the URL, escaped so a vhost
+// such as "team/a" stays one segment ("team%2Fa"). The default vhost "/" is
+// left out, keeping the URL ending in "/" as before.
+func (c Config) vhostPath() string {
+	if c.Vhost == "" || c.Vhost == "/" {
+		return ""
+	}
+
+	return url.PathEscape(c.Vhost)
+}
+
+// String keeps the password out of %v and %s, so printing a Config is safe.
+func (c Config) String() string {
+	return c.RedactedURL()
+}
+
+func Connect(cfg Config) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(cfg.URL())
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w at %s: %w", ErrConnect, cfg.RedactedURL(), err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: %w", ErrChannelOpen, err)
+	}
+
+	return conn, ch, nil
+}
+
+// Ping dials RabbitMQ and opens a channel, closing both right away. It backs
+// the "ping" subcommand used as a container healthcheck.
+func Ping(cfg Config) error {
+	conn, ch, err := Connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	ch.Close()
+	return conn.Close()
+}
+
+func Consume(ch Channel, queue string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	if opts.Prefetch > 0 {
+		if err := ch.Qos(opts.Prefetch, 0, false); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrQos, err)
+		}
+	}
+
+	var args amqp.Table
+	if opts.QueueArgs != nil {
+		args = opts.QueueArgs(queue)
+	}
+
+	q, err := ch.QueueDeclare(
+		queue,
+		opts.Durable,
+		opts.AutoDelete,
+		opts.Exclusive,
+		false,
+		args,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w \"%s\": %w", ErrQueueDeclare, queue, err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name,
+		opts.Tag,
+		!opts.ManualAck,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConsumerRegister, err)
+	}
+
+	return msgs, nil
+}
+
+// ParseQueues splits a comma separated RABBITMQ_QUEUE value, ignoring blank
+// entries.
+func ParseQueues(value string) []string {
+	var queues []string
+	for _, q := range strings.Split(value, ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			queues = append(queues, q)
+		}
+	}
+
+	return queues
+}
+
+// ConsumeAll registers one consumer per queue and merges their deliveries into
+// a single channel, which is closed once every consumer is cancelled. With
+// more than one queue each consumer is tagged "<opts.Tag>-<queue>". The tags
+// are returned so the caller can cancel them on shutdown.
+func ConsumeAll(ch Channel, queues []string, opts ConsumeOptions) (<-chan amqp.Delivery, []string, error) {
+	tags := make([]string, 0, len(queues))
+	deliveries := make([]<-chan amqp.Delivery, 0, len(queues))
+	for _, queue := range queues {
+		queueOpts := opts
+		if len(queues) > 1 {
+			queueOpts.Tag = fmt.Sprintf("%s-%s", opts.Tag, queue)
+		}
+
+		msgs, err := Consume(ch, queue, queueOpts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("queue \"%s\": %w", queue, err)
+		}
+
+		tags = append(tags, queueOpts.Tag)
+		deliveries = append(deliveries, msgs)
+	}
+
+	return merge(deliveries), tags, nil
+}
+
+func merge(deliveries []<-chan amqp.Delivery) <-chan amqp.Delivery {
+	if len(deliveries) == 1 {
+		return deliveries[0]
+	}
+
+	out := make(chan amqp.Delivery)
+
+	var wg sync.WaitGroup
+	wg.Add(len(deliveries))
+	for _, d := range deliveries {
+		go func(d <-chan amqp.Delivery) {
+			defer wg.Done()
+			for msg := range d {
+				out <- msg
+			}
+		}(d)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
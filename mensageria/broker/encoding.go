@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDecompress wraps every failure to decompress a delivery body.
+var ErrDecompress = errors.New("failed to decompress delivery body")
+
+// Decompress returns delivery with its body gunzipped when its content
+// encoding is "gzip". Deliveries with no (or the "identity") content encoding
+// are returned as is. The decompressed body may not exceed maxBytes, so a small
+// compressed message cannot expand past the size limit of the consumer.
+func Decompress(delivery amqp.Delivery, maxBytes int) (amqp.Delivery, error) {
+	switch strings.ToLower(strings.TrimSpace(delivery.ContentEncoding)) {
+	case "", "identity":
+		return delivery, nil
+	case "gzip":
+	default:
+		return delivery, fmt.Errorf("%w: unsupported content encoding \"%s\"", ErrDecompress, delivery.ContentEncoding)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(delivery.Body))
+	if err != nil {
+		return delivery, fmt.Errorf("%w: %w", ErrDecompress, err)
+	}
+	defer r.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return delivery, fmt.Errorf("%w: %w", ErrDecompress, err)
+	}
+
+	if len(body) > maxBytes {
+		return delivery, fmt.Errorf("%w: decompressed body exceeds %d bytes", ErrDecompress, maxBytes)
+	}
+
+	delivery.Body = body
+	delivery.ContentEncoding = ""
+	return delivery, nil
+}
@@ -0,0 +1,17 @@
+package broker
+
+import "errors"
+
+// Sentinel errors wrapped by the helpers of this package, and by the services
+// when they declare their own topology, so callers can tell which step failed
+// with errors.Is. The broker's own *amqp.Error stays in the chain for
+// errors.As.
+var (
+	ErrConnect          = errors.New("failed to connect to rabbitmq")
+	ErrChannelOpen      = errors.New("failed to open a channel")
+	ErrQos              = errors.New("failed to set prefetch count")
+	ErrQueueDeclare     = errors.New("failed to declare queue")
+	ErrExchangeDeclare  = errors.New("failed to declare exchange")
+	ErrQueueBind        = errors.New("failed to bind queue")
+	ErrConsumerRegister = errors.New("failed to register a consumer")
+)
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestConsumeErrors fails each step of Consume and checks the error it returns
+// wraps the sentinel of that step, keeps the broker's *amqp.Error and still
+// reads as before.
+func TestConsumeErrors(t *testing.T) {
+	tests := []struct {
+		fail    string
+		want    error
+		message string
+	}{
+		{"qos", ErrQos, "failed to set prefetch count"},
+		{"declare", ErrQueueDeclare, `failed to declare queue "sensors"`},
+		{"consume", ErrConsumerRegister, "failed to register a consumer"},
+	}
+
+	sentinels := []error{ErrConnect, ErrChannelOpen, ErrQos, ErrQueueDeclare, ErrExchangeDeclare, ErrQueueBind, ErrConsumerRegister}
+
+	for _, tt := range tests {
+		ch := newFakeChannel()
+		ch.fail = tt.fail
+
+		_, err := Consume(ch, "sensors", ConsumeOptions{Tag: "controller", Prefetch: 5})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("failing %s: err = %v, want %v", tt.fail, err, tt.want)
+			continue
+		}
+
+		for _, other := range sentinels {
+			if other != tt.want && errors.Is(err, other) {
+				t.Errorf("failing %s: err also matches %v", tt.fail, other)
+			}
+		}
+
+		var amqpErr *amqp.Error
+		if !errors.As(err, &amqpErr) {
+			t.Errorf("failing %s: the *amqp.Error was lost from %v", tt.fail, err)
+		}
+
+		if !strings.HasPrefix(err.Error(), tt.message) {
+			t.Errorf("failing %s: err = %q, want it to start with %q", tt.fail, err, tt.message)
+		}
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	cfg := Config{Username: "user", Password: "s3cr3t", Host: "127.0.0.1", Port: "1"}
+
+	_, _, err := Connect(cfg)
+	if !errors.Is(err, ErrConnect) {
+		t.Fatalf("Connect to a closed port = %v, want ErrConnect", err)
+	}
+
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("the connect error carries the password: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const redacted = "****"
+
+// checkConfig is set by the -check-config flag.
+var checkConfig bool
+
+// EnvVars lists the environment variables read by this package, for services
+// to include in ParseFlags and LogConfig.
+var EnvVars = []string{
+	"RABBITMQ_URL",
+	"RABBITMQ_USERNAME",
+	"RABBITMQ_PASSWORD",
+	"RABBITMQ_HOST",
+	"RABBITMQ_PORT",
+	"RABBITMQ_VHOST",
+	"CONSUMER_TAG",
+	"QUEUE_DURABLE",
+	"QUEUE_AUTO_DELETE",
+	"QUEUE_EXCLUSIVE",
+	"PREFETCH_COUNT",
+	"RECONNECT_BACKOFF",
+	"RECONNECT_MAX_BACKOFF",
+	"RECONNECT_JITTER",
+	"RECONNECT_JITTER_MODE",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"MESSAGE_SCHEMA_PATH",
+	"REPLAY_EXCHANGE",
+	"REPLAY_ROUTING_KEY",
+	"REPLAY_RATE",
+}
+
+// FlagName turns an environment variable name into its command-line flag,
+// e.g. RABBITMQ_HOST becomes rabbitmq-host.
+func FlagName(envVar string) string {
+	return strings.ReplaceAll(strings.ToLower(envVar), "_", "-")
+}
+
+// ParseFlags defines a flag for each of envVars, plus -check-config, and parses
+// the command line. Flags that were given are written back to the environment,
+// so everything reading configuration through os.Getenv sees
+// flag > env > default. Each of envVars may also be read from the file named by
+// its _FILE variable, e.g. RABBITMQ_PASSWORD_FILE.
+func ParseFlags(envVars []string) error {
+	names := make(map[string]string, len(envVars))
+	for _, name := range envVars {
+		names[FlagName(name)] = name
+		flag.String(FlagName(name), "", fmt.Sprintf("overrides the %s environment variable", name))
+	}
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the configuration and exit without connecting to RabbitMQ")
+	flag.Parse()
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		if _, ok := names[f.Name]; !ok {
+			return
+		}
+
+		if setErr := os.Setenv(names[f.Name], f.Value.String()); setErr != nil {
+			err = fmt.Errorf("failed to apply flag \"-%s\": %w", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return loadFiles(envVars)
+}
+
+// CheckConfigOnly reports whether -check-config was given: the service
+// should validate its configuration, then exit before dialing RabbitMQ.
+func CheckConfigOnly() bool {
+	return checkConfig
+}
+
+// Command is the subcommand given after the flags, e.g. "ping", or empty when
+// the service should just run.
+func Command() string {
+	return flag.Arg(0)
+}
+
+// CommandArgs are the arguments given after the subcommand, e.g. the file of
+// "replay <file>".
+func CommandArgs() []string {
+	if flag.NArg() == 0 {
+		return nil
+	}
+
+	return flag.Args()[1:]
+}
+
+// LogConfig logs the value of each of envVars, as resolved from flags and the
+// environment. Unset variables are reported as "(default)", and anything that
+// looks like a secret is redacted.
+func LogConfig(envVars []string) {
+	for _, name := range envVars {
+		value, ok := os.LookupEnv(name)
+		switch {
+		case !ok || value == "":
+			value = "(default)"
+		case isSecret(name):
+			value = redacted
+		case isHeaderList(name):
+			value = redactHeaders(value)
+		default:
+			value = redactURL(value)
+		}
+
+		log.Printf("config %s=%s", name, value)
+	}
+}
+
+// redactURL replaces the password of a URL such as RABBITMQ_URL with "****".
+// Anything that is not a URL carrying a password is returned unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// isHeaderList reports whether name holds Name=value header pairs such as
+// PUSH_HEADERS, whose values often carry tenant IDs or API keys.
+func isHeaderList(name string) bool {
+	return strings.HasSuffix(name, "HEADERS")
+}
+
+// redactHeaders replaces the value of each Name=value pair of a header list
+// with "****", keeping the names so the log still shows which headers are set.
+func redactHeaders(value string) string {
+	entries := strings.Split(value, ",")
+	for i, entry := range entries {
+		if name, _, ok := strings.Cut(entry, "="); ok {
+			entries[i] = name + "=" + redacted
+		}
+	}
+
+	return strings.Join(entries, ",")
+}
+
+func isSecret(name string) bool {
+	for _, marker := range []string{"PASSWORD", "SECRET", "TOKEN"} {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"context"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Handler processes a single delivery.
+type Handler func(ctx context.Context, delivery amqp.Delivery) error
+
+// Middleware wraps a Handler with a cross-cutting concern. It may
+// short-circuit the pipeline by returning without calling next.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with middlewares, the first one outermost: Chain(h, a, b)
+// handles a delivery as a(b(h)).
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// Trace starts a consumer span called name for every delivery, continuing the
+// trace propagated in its headers, and records the error next returns.
+func Trace(tracer trace.Tracer, name string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			ctx, span := tracer.Start(ExtractTraceContext(ctx, delivery), name, trace.WithSpanKind(trace.SpanKindConsumer))
+			defer span.End()
+
+			err := next(ctx, delivery)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+
+			return err
+		}
+	}
+}
+
+// ContentTypeMatches reports whether the content type of a delivery is the
+// expected one, ignoring case and any parameters such as "; charset=utf-8".
+func ContentTypeMatches(expected, actual string) bool {
+	return strings.EqualFold(mediaType(expected), mediaType(actual))
+}
+
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(t)
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingMiddleware appends name to calls on the way in and out of next.
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			*calls = append(*calls, name+" in")
+			err := next(ctx, delivery)
+			*calls = append(*calls, name+" out")
+			return err
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	h := Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, recordingMiddleware("a", &calls), recordingMiddleware("b", &calls))
+
+	if err := h(context.Background(), amqp.Delivery{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(calls), "[a in b in handler b out a out]"; got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestChainShortCircuit(t *testing.T) {
+	errRejected := errors.New("rejected")
+
+	var calls []string
+	reject := func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			calls = append(calls, "reject")
+			return errRejected
+		}
+	}
+
+	h := Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, recordingMiddleware("a", &calls), reject, recordingMiddleware("b", &calls))
+
+	if err := h(context.Background(), amqp.Delivery{}); !errors.Is(err, errRejected) {
+		t.Errorf("err = %v, want the error of the middleware that short-circuited", err)
+	}
+
+	if got, want := fmt.Sprint(calls), "[a in reject a out]"; got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestChainWithoutMiddlewares(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	h := Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		return errHandler
+	})
+
+	if err := h(context.Background(), amqp.Delivery{}); !errors.Is(err, errHandler) {
+		t.Errorf("err = %v, want the error of the handler", err)
+	}
+}
+
+func TestContentTypeMatches(t *testing.T) {
+	tests := []struct {
+		expected, actual string
+		want             bool
+	}{
+		{"application/json", "application/json", true},
+		{"application/json", "Application/JSON", true},
+		{"application/json", "application/json; charset=utf-8", true},
+		{"application/json; charset=utf-8", " application/json ", true},
+		{"application/json", "text/plain", false},
+		{"application/json", "", false},
+		{"application/json", "application/x-protobuf", false},
+	}
+
+	for _, tt := range tests {
+		if got := ContentTypeMatches(tt.expected, tt.actual); got != tt.want {
+			t.Errorf("ContentTypeMatches(%q, %q) = %t, want %t", tt.expected, tt.actual, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type job struct {
+	ctx      context.Context
+	handle   Handler
+	delivery amqp.Delivery
+}
+
+// Pool runs deliveries on a fixed number of worker goroutines, so a slow
+// delivery no longer holds back the ones after it. With a single worker
+// deliveries are still handled one at a time, in order.
+type Pool struct {
+	jobs chan job
+	wg   sync.WaitGroup
+}
+
+func NewPool(workers int) (*Pool, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid worker count %d: must be at least 1", workers)
+	}
+
+	p := &Pool{jobs: make(chan job)}
+	for range workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range p.jobs {
+				j.handle(j.ctx, j.delivery)
+			}
+		}()
+	}
+
+	return p, nil
+}
+
+// Submit hands delivery to the next free worker, blocking while every worker
+// is busy. It gives up with the error of ctx once ctx is done, leaving the
+// delivery unhandled, so a stuck worker cannot keep the caller from shutting
+// down. The handler is passed along with the delivery, rather than fixed when
+// the pool is created, so a handler rebuilt after a reconnect only applies to
+// the deliveries of the new channel.
+func (p *Pool) Submit(ctx context.Context, handle Handler, delivery amqp.Delivery) error {
+	select {
+	case p.jobs <- job{ctx: ctx, handle: handle, delivery: delivery}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting deliveries and waits for the workers to finish the
+// ones they hold. Submit must not be called afterwards.
+func (p *Pool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
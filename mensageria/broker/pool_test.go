@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPoolSingleWorkerKeepsOrder(t *testing.T) {
+	pool, err := NewPool(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint64
+	handle := func(ctx context.Context, delivery amqp.Delivery) error {
+		got = append(got, delivery.DeliveryTag)
+		return nil
+	}
+
+	for tag := uint64(1); tag <= 5; tag++ {
+		if err := pool.Submit(context.Background(), handle, amqp.Delivery{DeliveryTag: tag}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Close()
+
+	for i, tag := range got {
+		if tag != uint64(i+1) {
+			t.Fatalf("handled %v, want deliveries in order", got)
+		}
+	}
+
+	if len(got) != 5 {
+		t.Errorf("handled %d deliveries, want 5", len(got))
+	}
+}
+
+// TestPoolSubmitGivesUpOnContext checks Submit returns once ctx is done
+// instead of blocking behind a worker that never finishes.
+func TestPoolSubmitGivesUpOnContext(t *testing.T) {
+	pool, err := NewPool(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	block := func(ctx context.Context, delivery amqp.Delivery) error {
+		close(started)
+		<-release
+		return nil
+	}
+
+	if err := pool.Submit(context.Background(), block, amqp.Delivery{}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = pool.Submit(ctx, block, amqp.Delivery{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Submit = %v, want context.DeadlineExceeded", err)
+	}
+
+	close(release)
+	pool.Close()
+}
+
+// TestPoolBoundsConcurrencyUnderLoad submits deliveries from several
+// goroutines at once and checks no more than the workers ever run together,
+// and that Close returns only once every delivery was handled. It is meant to
+// be run with -race too.
+func TestPoolBoundsConcurrencyUnderLoad(t *testing.T) {
+	const workers, submitters, perSubmitter = 4, 8, 50
+
+	pool, err := NewPool(workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, maxRunning, handled atomic.Int64
+	handle := func(ctx context.Context, delivery amqp.Delivery) error {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Microsecond)
+		running.Add(-1)
+		handled.Add(1)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for range submitters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perSubmitter {
+				if err := pool.Submit(context.Background(), handle, amqp.Delivery{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Close()
+
+	if got := handled.Load(); got != submitters*perSubmitter {
+		t.Errorf("Close returned with %d deliveries handled, want %d", got, submitters*perSubmitter)
+	}
+
+	if got := maxRunning.Load(); got > workers {
+		t.Errorf("%d deliveries ran at once, want at most %d", got, workers)
+	}
+}
+
+func TestNewPoolRejectsNoWorkers(t *testing.T) {
+	if _, err := NewPool(0); err == nil {
+		t.Error("NewPool(0) did not fail")
+	}
+}
+
+func BenchmarkPool(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool, err := NewPool(workers)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			handle := func(ctx context.Context, delivery amqp.Delivery) error {
+				wg.Done()
+				return nil
+			}
+
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wg.Add(1)
+				if err := pool.Submit(ctx, handle, amqp.Delivery{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			pool.Close()
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// State is the connection and channel lifecycle reported by NotifyState.
+type State struct {
+	Connected   bool
+	ChannelOpen bool
+}
+
+// NotifyState calls fn with the current state right away and again whenever
+// the broker or the client closes the channel or the connection. It also logs
+// every consumer the broker cancels (e.g. when its queue is deleted), since
+// that closes the deliveries channel while the channel itself stays open.
+//
+// It is called again for every channel reopened on conn, but conn is only
+// watched once, by the first call, until it closes.
+func NotifyState(conn *amqp.Connection, ch *amqp.Channel, fn func(State)) {
+	notifyState(conn, ch, fn)
+}
+
+// closeNotifier is the part of *amqp.Connection and *amqp.Channel NotifyState
+// watches.
+type closeNotifier interface {
+	IsClosed() bool
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+}
+
+type cancelNotifier interface {
+	closeNotifier
+	NotifyCancel(receiver chan string) chan string
+}
+
+// connWatch is the state of a watched connection, shared by the watchers of
+// the channels opened on it in turn. channel is the latest of them, so the
+// late close of a replaced channel does not mark its successor closed.
+type connWatch struct {
+	mu      sync.Mutex
+	state   State
+	channel cancelNotifier
+	fn      func(State)
+}
+
+func (w *connWatch) update(change func(*State)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	change(&w.state)
+	w.fn(w.state)
+}
+
+// connWatches holds the connections NotifyState is watching, until they close.
+var (
+	connWatches   = map[closeNotifier]*connWatch{}
+	connWatchesMu sync.Mutex
+)
+
+func notifyState(conn closeNotifier, ch cancelNotifier, fn func(State)) {
+	w := watchConnection(conn, fn)
+	w.update(func(s *State) {
+		w.channel = ch
+		s.ChannelOpen = !ch.IsClosed()
+	})
+
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	cancelled := ch.NotifyCancel(make(chan string, 1))
+
+	go func() {
+		for chClosed != nil {
+			select {
+			case err := <-chClosed:
+				chClosed = nil
+				w.update(func(s *State) {
+					if w.channel == ch {
+						s.ChannelOpen = false
+					}
+				})
+				if err != nil {
+					log.Printf("channel closed by the broker: %v", err)
+				}
+			case tag, ok := <-cancelled:
+				if !ok {
+					cancelled = nil
+				} else {
+					log.Printf("consumer \"%s\" was cancelled by the broker", tag)
+				}
+			}
+		}
+	}()
+}
+
+// watchConnection returns the watch of conn, registering a single NotifyClose
+// on conn the first time.
+func watchConnection(conn closeNotifier, fn func(State)) *connWatch {
+	connWatchesMu.Lock()
+	defer connWatchesMu.Unlock()
+
+	if w, ok := connWatches[conn]; ok {
+		return w
+	}
+
+	w := &connWatch{state: State{Connected: !conn.IsClosed()}, fn: fn}
+	connWatches[conn] = w
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+		w.update(func(s *State) { s.Connected = false })
+
+		connWatchesMu.Lock()
+		delete(connWatches, conn)
+		connWatchesMu.Unlock()
+	}()
+
+	return w
+}
+
+const (
+	JitterFull  = "full"
+	JitterEqual = "equal"
+)
+
+// Backoff is the schedule Reconnect waits on between attempts: Initial,
+// doubling up to Max. Jitter is the fraction (0..1) of each wait that is
+// randomized so replicas spread their retries; JitterFull spreads it over the
+// whole fraction, JitterEqual only over its upper half.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Jitter     float64
+	JitterMode string
+}
+
+// BackoffFromEnv reads the RECONNECT_BACKOFF, RECONNECT_MAX_BACKOFF,
+// RECONNECT_JITTER and RECONNECT_JITTER_MODE settings. Unset ones keep the
+// values given in defaults.
+func BackoffFromEnv(defaults Backoff) (Backoff, error) {
+	b := defaults
+
+	var err error
+	if b.Initial, err = envDuration("RECONNECT_BACKOFF", defaults.Initial); err != nil {
+		return Backoff{}, err
+	}
+
+	if b.Max, err = envDuration("RECONNECT_MAX_BACKOFF", defaults.Max); err != nil {
+		return Backoff{}, err
+	}
+
+	if b.Jitter, err = envFloat("RECONNECT_JITTER", defaults.Jitter); err != nil {
+		return Backoff{}, err
+	}
+
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return Backoff{}, fmt.Errorf("invalid RECONNECT_JITTER \"%g\": must be between 0 and 1", b.Jitter)
+	}
+
+	if mode := os.Getenv("RECONNECT_JITTER_MODE"); mode != "" {
+		b.JitterMode = mode
+	}
+
+	switch b.JitterMode {
+	case "":
+		b.JitterMode = JitterFull
+	case JitterFull, JitterEqual:
+	default:
+		return Backoff{}, fmt.Errorf("invalid RECONNECT_JITTER_MODE \"%s\": must be %s or %s", b.JitterMode, JitterFull, JitterEqual)
+	}
+
+	return b, nil
+}
+
+// wait applies the jitter to d. With a full jitter of 1 the result is uniform
+// in [0, d); with an equal jitter of 1 it is uniform in [d/2, d).
+func (b Backoff) wait(d time.Duration) time.Duration {
+	spread := b.Jitter * float64(d)
+	if b.JitterMode == JitterEqual {
+		spread /= 2
+	}
+
+	return time.Duration(float64(d) - spread + rand.Float64()*spread)
+}
+
+// Reconnect calls Connect until it succeeds or ctx is done, waiting between
+// attempts as scheduled by backoff.
+func Reconnect(ctx context.Context, cfg Config, backoff Backoff) (*amqp.Connection, *amqp.Channel, error) {
+	delay := backoff.Initial
+	for attempt := 1; ; attempt++ {
+		conn, ch, err := Connect(cfg)
+		if err == nil {
+			return conn, ch, nil
+		}
+
+		wait := backoff.wait(delay)
+		log.Printf("reconnect attempt %d failed, retrying in %s: %v", attempt, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		delay = min(delay*2, backoff.Max)
+	}
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeNotifier stands in for *amqp.Connection and *amqp.Channel, counting the
+// NotifyClose listeners registered on it and closing them on close.
+type fakeNotifier struct {
+	mu        sync.Mutex
+	closed    bool
+	listeners []chan *amqp.Error
+	cancels   []chan string
+}
+
+func (f *fakeNotifier) IsClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+func (f *fakeNotifier) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.listeners = append(f.listeners, receiver)
+	return receiver
+}
+
+func (f *fakeNotifier) NotifyCancel(receiver chan string) chan string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cancels = append(f.cancels, receiver)
+	return receiver
+}
+
+func (f *fakeNotifier) registered() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.listeners)
+}
+
+func (f *fakeNotifier) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for _, l := range f.listeners {
+		close(l)
+	}
+	for _, c := range f.cancels {
+		close(c)
+	}
+	f.listeners, f.cancels = nil, nil
+}
+
+// fail closes f as the broker does, delivering err to every close listener.
+func (f *fakeNotifier) fail(err *amqp.Error) {
+	f.mu.Lock()
+	for _, l := range f.listeners {
+		l <- err
+	}
+	f.mu.Unlock()
+
+	f.close()
+}
+
+// cancel delivers the broker cancelling the consumer tag.
+func (f *fakeNotifier) cancel(tag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.cancels {
+		c <- tag
+	}
+}
+
+// logBuffer collects the log output of the goroutines NotifyState starts.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// captureLog sends the log output to a logBuffer for the rest of the test.
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return b
+}
+
+// waitForLog waits until the log contains want.
+func waitForLog(t *testing.T, b *logBuffer, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(b.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the log does not contain %q:\n%s", want, b.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// stateRecorder records the states NotifyState reports.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []State
+}
+
+func (r *stateRecorder) record(s State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.states = append(r.states, s)
+}
+
+// waitFor waits until the last state reported is want.
+func (r *stateRecorder) waitFor(t *testing.T, want State) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		n := len(r.states)
+		last := State{}
+		if n > 0 {
+			last = r.states[n-1]
+		}
+		r.mu.Unlock()
+
+		if n > 0 && last == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("last state is not %+v: %+v", want, r.states)
+}
+
+// TestNotifyStateWatchesConnectionOnce reopens channels on one connection and
+// checks the connection gets a single close listener, while each channel
+// still reports its own state.
+func TestNotifyStateWatchesConnectionOnce(t *testing.T) {
+	conn := &fakeNotifier{}
+	r := &stateRecorder{}
+
+	first := &fakeNotifier{}
+	notifyState(conn, first, r.record)
+	r.waitFor(t, State{Connected: true, ChannelOpen: true})
+
+	for range 3 {
+		first.close()
+		r.waitFor(t, State{Connected: true, ChannelOpen: false})
+
+		first = &fakeNotifier{}
+		notifyState(conn, first, r.record)
+		r.waitFor(t, State{Connected: true, ChannelOpen: true})
+	}
+
+	if got := conn.registered(); got != 1 {
+		t.Errorf("the connection has %d close listeners, want 1", got)
+	}
+
+	conn.close()
+	first.close()
+	r.waitFor(t, State{Connected: false, ChannelOpen: false})
+
+	// Once closed, the connection is no longer watched.
+	deadline := time.Now().Add(time.Second)
+	for {
+		connWatchesMu.Lock()
+		_, watched := connWatches[conn]
+		connWatchesMu.Unlock()
+
+		if !watched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the closed connection is still watched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestNotifyStateIgnoresReplacedChannel checks the late close of a channel
+// already replaced does not mark the new one closed.
+func TestNotifyStateIgnoresReplacedChannel(t *testing.T) {
+	conn := &fakeNotifier{}
+	r := &stateRecorder{}
+
+	old := &fakeNotifier{}
+	notifyState(conn, old, r.record)
+	notifyState(conn, &fakeNotifier{}, r.record)
+
+	old.close()
+	time.Sleep(10 * time.Millisecond)
+	r.waitFor(t, State{Connected: true, ChannelOpen: true})
+}
+
+// TestNotifyStateLogsWhyDeliveriesStopped checks the reason the deliveries
+// channel closed is logged: the broker cancelling the consumer, which leaves
+// the channel open, and the broker closing the channel with an error.
+func TestNotifyStateLogsWhyDeliveriesStopped(t *testing.T) {
+	logged := captureLog(t)
+	conn := &fakeNotifier{}
+	ch := &fakeNotifier{}
+	r := &stateRecorder{}
+
+	notifyState(conn, ch, r.record)
+	r.waitFor(t, State{Connected: true, ChannelOpen: true})
+
+	ch.cancel("controller")
+	waitForLog(t, logged, `consumer "controller" was cancelled by the broker`)
+	r.waitFor(t, State{Connected: true, ChannelOpen: true})
+
+	ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - unknown delivery tag"})
+	waitForLog(t, logged, "channel closed by the broker: Exception (406) Reason: \"PRECONDITION_FAILED - unknown delivery tag\"")
+	r.waitFor(t, State{Connected: true, ChannelOpen: false})
+}
+
+// TestNotifyStateClientCloseNotLogged checks a channel the client closes
+// itself, which carries no error, is not reported as closed by the broker.
+func TestNotifyStateClientCloseNotLogged(t *testing.T) {
+	logged := captureLog(t)
+	conn := &fakeNotifier{}
+	ch := &fakeNotifier{}
+	r := &stateRecorder{}
+
+	notifyState(conn, ch, r.record)
+	ch.close()
+	r.waitFor(t, State{Connected: true, ChannelOpen: false})
+
+	if strings.Contains(logged.String(), "closed by the broker") {
+		t.Errorf("a client close was logged as closed by the broker:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher is the part of *amqp.Channel that Replay publishes with.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// ReplayOptions says where the replayed messages are published and how fast.
+type ReplayOptions struct {
+	Exchange string
+	Key      string
+	// Rate is the number of messages published per second. Zero publishes
+	// them as fast as the broker takes them.
+	Rate float64
+}
+
+// ReplayOptionsFromEnv reads REPLAY_EXCHANGE, REPLAY_ROUTING_KEY and
+// REPLAY_RATE. By default messages go through the default exchange to the
+// first of queues, the service's own input.
+func ReplayOptionsFromEnv(queues []string) (ReplayOptions, error) {
+	opts := ReplayOptions{Exchange: os.Getenv("REPLAY_EXCHANGE"), Key: os.Getenv("REPLAY_ROUTING_KEY")}
+	if opts.Key == "" && len(queues) > 0 {
+		opts.Key = queues[0]
+	}
+
+	if opts.Exchange == "" && opts.Key == "" {
+		return ReplayOptions{}, errors.New("replay needs REPLAY_EXCHANGE, REPLAY_ROUTING_KEY or RABBITMQ_QUEUE to know where to publish")
+	}
+
+	var err error
+	if opts.Rate, err = envFloat("REPLAY_RATE", 0); err != nil {
+		return ReplayOptions{}, err
+	}
+
+	if opts.Rate < 0 {
+		return ReplayOptions{}, fmt.Errorf("invalid REPLAY_RATE \"%g\": must not be negative", opts.Rate)
+	}
+
+	return opts, nil
+}
+
+// Replay publishes every line of r, newline-delimited JSON as captured from a
+// queue, as a message of its own. Blank lines are skipped, and a line that is
+// not JSON stops the replay before it is published. It returns the number of
+// messages published.
+func Replay(ctx context.Context, ch Publisher, r io.Reader, opts ReplayOptions) (int, error) {
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	reader := bufio.NewReader(r)
+	published := 0
+	for line := 1; ; line++ {
+		body, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return published, fmt.Errorf("failed to read line %d: %w", line, err)
+		}
+		eof := err != nil
+
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 {
+			if !json.Valid(body) {
+				return published, fmt.Errorf("line %d is not valid JSON", line)
+			}
+
+			if tick != nil && published > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return published, ctx.Err()
+				}
+			}
+
+			msg := amqp.Publishing{ContentType: "application/json", Body: body}
+			if err := ch.PublishWithContext(ctx, opts.Exchange, opts.Key, false, false, msg); err != nil {
+				return published, fmt.Errorf("failed to publish line %d: %w", line, err)
+			}
+			published++
+		}
+
+		if eof {
+			return published, nil
+		}
+	}
+}
+
+// ReplayFile connects to RabbitMQ and replays the NDJSON file at path. It
+// stops early on SIGINT/SIGTERM.
+func ReplayFile(cfg Config, path string, opts ReplayOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open replay file: %w", err)
+	}
+	defer f.Close()
+
+	conn, ch, err := Connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer ch.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	published, err := Replay(ctx, ch, f, opts)
+	log.Printf("replayed %d messages from \"%s\" to exchange \"%s\" with routing key \"%s\"", published, path, opts.Exchange, opts.Key)
+
+	return err
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakePublisher records the messages published to it, failing from the
+// failAt-th one on when failAt is set.
+type fakePublisher struct {
+	mu     sync.Mutex
+	routes []string
+	bodies []string
+	failAt int
+}
+
+func (p *fakePublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failAt > 0 && len(p.bodies)+1 >= p.failAt {
+		return amqp.ErrClosed
+	}
+
+	p.routes = append(p.routes, exchange+"/"+key)
+	p.bodies = append(p.bodies, string(msg.Body))
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	input := `{"sensors":[{"Id":"001"}]}` + "\n\n" +
+		`  {"sensors":[{"Id":"002"}]}  ` + "\n" +
+		`{"sensors":[{"Id":"003"}]}`
+
+	p := &fakePublisher{}
+	published, err := Replay(context.Background(), p, strings.NewReader(input), ReplayOptions{Key: "sensors"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if published != 3 || len(p.bodies) != 3 {
+		t.Fatalf("Replay published %d messages, recorded %d, want 3", published, len(p.bodies))
+	}
+
+	if p.bodies[1] != `{"sensors":[{"Id":"002"}]}` {
+		t.Errorf("second message = %q, want the line trimmed", p.bodies[1])
+	}
+
+	for _, route := range p.routes {
+		if route != "/sensors" {
+			t.Errorf("published to %s, want the default exchange with key sensors", route)
+		}
+	}
+}
+
+func TestReplayStopsOnInvalidLine(t *testing.T) {
+	p := &fakePublisher{}
+	published, err := Replay(context.Background(), p, strings.NewReader("{}\nnot json\n{}\n"), ReplayOptions{Key: "sensors"})
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want line 2 reported", err)
+	}
+
+	if published != 1 {
+		t.Errorf("published %d messages, want the one before the invalid line", published)
+	}
+}
+
+func TestReplayPublishError(t *testing.T) {
+	p := &fakePublisher{failAt: 2}
+	published, err := Replay(context.Background(), p, strings.NewReader("{}\n{}\n{}\n"), ReplayOptions{Key: "sensors"})
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("err = %v, want the publish error", err)
+	}
+
+	if published != 1 {
+		t.Errorf("published %d messages, want 1", published)
+	}
+}
+
+// TestReplayRate checks REPLAY_RATE spaces the publishes out: four messages at
+// 50 per second take at least three intervals of 20ms.
+func TestReplayRate(t *testing.T) {
+	p := &fakePublisher{}
+	start := time.Now()
+
+	published, err := Replay(context.Background(), p, strings.NewReader("{}\n{}\n{}\n{}\n"), ReplayOptions{Key: "sensors", Rate: 50})
+	if err != nil || published != 4 {
+		t.Fatalf("Replay = %d, %v, want 4 messages", published, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("four messages at 50/s were replayed in %s", elapsed)
+	}
+}
+
+func TestReplayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &fakePublisher{}
+	published, err := Replay(ctx, p, strings.NewReader("{}\n{}\n"), ReplayOptions{Key: "sensors", Rate: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+
+	if published != 1 {
+		t.Errorf("published %d messages, want only the first one, which is not held by the rate", published)
+	}
+}
+
+func TestReplayOptionsFromEnv(t *testing.T) {
+	t.Setenv("REPLAY_EXCHANGE", "")
+	t.Setenv("REPLAY_ROUTING_KEY", "")
+	t.Setenv("REPLAY_RATE", "")
+
+	opts, err := ReplayOptionsFromEnv([]string{"sensors", "other"})
+	if err != nil || opts != (ReplayOptions{Key: "sensors"}) {
+		t.Errorf("ReplayOptionsFromEnv = %+v, %v, want the first queue", opts, err)
+	}
+
+	if _, err := ReplayOptionsFromEnv(nil); err == nil {
+		t.Error("replay without a destination was accepted")
+	}
+
+	t.Setenv("REPLAY_EXCHANGE", "all")
+	t.Setenv("REPLAY_ROUTING_KEY", "q1")
+	t.Setenv("REPLAY_RATE", "2.5")
+	opts, err = ReplayOptionsFromEnv([]string{"sensors"})
+	if err != nil || opts != (ReplayOptions{Exchange: "all", Key: "q1", Rate: 2.5}) {
+		t.Errorf("ReplayOptionsFromEnv = %+v, %v", opts, err)
+	}
+
+	for _, rate := range []string{"-1", "fast"} {
+		t.Setenv("REPLAY_RATE", rate)
+		if _, err := ReplayOptionsFromEnv([]string{"sensors"}); err == nil {
+			t.Errorf("REPLAY_RATE %q was accepted", rate)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ErrSchemaValidation wraps every delivery body that does not match the
+// MESSAGE_SCHEMA_PATH schema, or is not JSON at all.
+var ErrSchemaValidation = errors.New("message does not match the schema")
+
+// Schema validates delivery bodies against a JSON Schema, so producer
+// contracts such as required nested fields are enforced before a message is
+// processed.
+type Schema struct {
+	path   string
+	schema *jsonschema.Schema
+}
+
+// LoadSchema compiles the JSON Schema file at path. Every draft the schema may
+// declare in "$schema" is supported, 2020-12 being assumed when it declares
+// none.
+func LoadSchema(path string) (*Schema, error) {
+	schema, err := jsonschema.NewCompiler().Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema \"%s\": %w", path, err)
+	}
+
+	return &Schema{path: path, schema: schema}, nil
+}
+
+// SchemaFromEnv loads the schema at MESSAGE_SCHEMA_PATH. It returns nil, and
+// validation is skipped, when the variable is unset.
+func SchemaFromEnv() (*Schema, error) {
+	path := os.Getenv("MESSAGE_SCHEMA_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	return LoadSchema(path)
+}
+
+// Validate reports why body does not match the schema, wrapped in
+// ErrSchemaValidation.
+func (s *Schema) Validate(body []byte) error {
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w \"%s\": %w", ErrSchemaValidation, s.path, err)
+	}
+
+	if err := s.schema.Validate(instance); err != nil {
+		return fmt.Errorf("%w \"%s\": %w", ErrSchemaValidation, s.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileSuffix is the suffix of the variable naming a file that holds the value
+// of another, the convention of Docker and Kubernetes secrets:
+// RABBITMQ_PASSWORD_FILE=/run/secrets/rabbitmq_password.
+const fileSuffix = "_FILE"
+
+// loadFiles sets each of envVars whose <name>_FILE variable is set to the
+// content of that file, without its trailing newline, so the secret never has
+// to sit in the environment of the container. Setting both a variable (or its
+// flag) and its _FILE is an error rather than a silent pick of one.
+func loadFiles(envVars []string) error {
+	for _, name := range envVars {
+		path := os.Getenv(name + fileSuffix)
+		if path == "" {
+			continue
+		}
+
+		if os.Getenv(name) != "" {
+			return fmt.Errorf("both %s and %s%s are set, only one may be", name, name, fileSuffix)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s%s: %w", name, fileSuffix, err)
+		}
+
+		if err := os.Setenv(name, strings.TrimRight(string(content), "\r\n")); err != nil {
+			return fmt.Errorf("failed to apply %s%s: %w", name, fileSuffix, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSecret writes content to a file of the test's temporary directory and
+// returns its path.
+func writeSecret(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadFiles(t *testing.T) {
+	t.Setenv("RABBITMQ_PASSWORD", "")
+	t.Setenv("RABBITMQ_PASSWORD_FILE", writeSecret(t, "s3cr3t\r\n"))
+	t.Setenv("RABBITMQ_USERNAME", "user")
+	t.Setenv("RABBITMQ_USERNAME_FILE", "")
+
+	if err := loadFiles([]string{"RABBITMQ_PASSWORD", "RABBITMQ_USERNAME"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := os.Getenv("RABBITMQ_PASSWORD"); got != "s3cr3t" {
+		t.Errorf("RABBITMQ_PASSWORD = %q, want the file without its trailing newline", got)
+	}
+	if got := os.Getenv("RABBITMQ_USERNAME"); got != "user" {
+		t.Errorf("RABBITMQ_USERNAME without a _FILE = %q, want it untouched", got)
+	}
+}
+
+func TestLoadFilesBothSet(t *testing.T) {
+	t.Setenv("RABBITMQ_PASSWORD", "from-env")
+	t.Setenv("RABBITMQ_PASSWORD_FILE", writeSecret(t, "from-file"))
+
+	err := loadFiles([]string{"RABBITMQ_PASSWORD"})
+	if err == nil || !strings.Contains(err.Error(), "RABBITMQ_PASSWORD_FILE") {
+		t.Errorf("loadFiles with both set = %v, want an error naming both", err)
+	}
+	if got := os.Getenv("RABBITMQ_PASSWORD"); got != "from-env" {
+		t.Errorf("RABBITMQ_PASSWORD = %q, want it left as it was", got)
+	}
+}
+
+func TestLoadFilesMissingFile(t *testing.T) {
+	t.Setenv("RABBITMQ_PASSWORD", "")
+	t.Setenv("RABBITMQ_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	err := loadFiles([]string{"RABBITMQ_PASSWORD"})
+	if err == nil || !strings.Contains(err.Error(), "RABBITMQ_PASSWORD_FILE") {
+		t.Errorf("loadFiles with a missing file = %v, want an error naming RABBITMQ_PASSWORD_FILE", err)
+	}
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Operations tracks the work in flight, so the shutdown watchdog can report
+// what it abandons.
+type Operations struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]string
+}
+
+func NewOperations() *Operations {
+	return &Operations{pending: map[uint64]string{}}
+}
+
+// Start records an operation described by desc until the returned function is
+// called.
+func (o *Operations) Start(desc string) func() {
+	o.mu.Lock()
+	id := o.next
+	o.next++
+	o.pending[id] = desc
+	o.mu.Unlock()
+
+	return func() {
+		o.mu.Lock()
+		delete(o.pending, id)
+		o.mu.Unlock()
+	}
+}
+
+// Pending lists the operations still in flight, oldest first.
+func (o *Operations) Pending() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ids := make([]uint64, 0, len(o.pending))
+	for id := range o.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	descs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		descs = append(descs, o.pending[id])
+	}
+
+	return descs
+}
+
+// Track is a Middleware recording every delivery in ops while it is handled.
+func Track(ops *Operations) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			defer ops.Start(fmt.Sprintf("delivery %d with routing key \"%s\"", delivery.DeliveryTag, delivery.RoutingKey))()
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// StartWatchdog exits the process once timeout elapses, logging the
+// operations of ops it abandons. It is meant to be started when shutdown
+// begins, so a push or publish that never returns cannot keep the process
+// alive past the orchestrator's grace period.
+func StartWatchdog(timeout time.Duration, ops *Operations) {
+	time.AfterFunc(timeout, func() {
+		pending := ops.Pending()
+		log.Printf("shutdown did not finish within %s, forcing exit with %d operation(s) in flight", timeout, len(pending))
+		for _, desc := range pending {
+			log.Printf("abandoned %s", desc)
+		}
+		os.Exit(1)
+	})
+}
+
+// ShutdownTimeoutWarning explains why timeout, the SHUTDOWN_TIMEOUT, does not
+// cover the grace period plus the work a service still does once it elapses,
+// such as waiting for publisher confirms, so the watchdog would cut that work
+// short. It is empty when timeout leaves room for both.
+func ShutdownTimeoutWarning(timeout, gracePeriod, after time.Duration) string {
+	if timeout >= gracePeriod+after {
+		return ""
+	}
+
+	if after == 0 {
+		return fmt.Sprintf("SHUTDOWN_TIMEOUT (%s) is shorter than SHUTDOWN_GRACE_PERIOD (%s), in-flight work may be abandoned before the grace period ends", timeout, gracePeriod)
+	}
+
+	return fmt.Sprintf("SHUTDOWN_TIMEOUT (%s) is shorter than SHUTDOWN_GRACE_PERIOD (%s) plus the %s of work that follows it, in-flight work may be abandoned", timeout, gracePeriod, after)
+}
@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownTimeoutWarning(t *testing.T) {
+	tests := []struct {
+		timeout, grace, after time.Duration
+		want                  string
+	}{
+		{10 * time.Second, 5 * time.Second, 3 * time.Second, ""},
+		{10 * time.Second, 10 * time.Second, 0, ""},
+		{10 * time.Second, 10 * time.Second, 5 * time.Second, "plus the 5s of work"},
+		{5 * time.Second, 10 * time.Second, 0, "shorter than SHUTDOWN_GRACE_PERIOD (10s), in-flight"},
+	}
+
+	for _, tt := range tests {
+		got := ShutdownTimeoutWarning(tt.timeout, tt.grace, tt.after)
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("ShutdownTimeoutWarning(%s, %s, %s) = %q, want it to contain %q", tt.timeout, tt.grace, tt.after, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package broker
+
+import (
+	"log"
+	"runtime"
+)
+
+// Version and Commit are set at build time, e.g.
+//
+//	go build -ldflags "-X broker.Version=1.2.0 -X broker.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// GoVersion is the Go release the binary was built with.
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// LogBuildInfo logs the build of the running binary at startup.
+func LogBuildInfo(service string) {
+	log.Printf("%s version %s (commit %s, %s)", service, Version, Commit, GoVersion())
+}
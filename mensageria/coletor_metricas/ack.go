@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// reconnectRequests asks the main loop to reconnect, for a delivery that
+// failed with the reconnect action. Its buffer of one folds the requests of
+// the deliveries failing together into a single reconnect.
+var reconnectRequests = make(chan struct{}, 1)
+
+// acknowledge settles each delivery once the rest of the chain is done with
+// it, according to the action of its error (see ERROR_ACTIONS). Deliveries
+// handled, dropped or out of retries are acked. Dead-lettered ones are nacked
+// without requeue, so the broker routes them to the dead-letter exchange of
+// their queue. With the reconnect action the delivery is nacked and requeued,
+// to be handled again once the main loop has reconnected.
+// A batch of which some elements were pushed is acked whatever the failures of
+// the others, so it is never handled again.
+func acknowledge(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		err := next(ctx, delivery)
+
+		var settleErr error
+		switch {
+		case err == nil, errors.Is(err, errPartialBatch):
+			settleErr = delivery.Ack(false)
+		case actionFor(err) == actionDeadLetter:
+			settleErr = delivery.Nack(false, false)
+		case actionFor(err) == actionReconnect:
+			settleErr = delivery.Nack(false, true)
+			requestReconnect()
+		default:
+			settleErr = delivery.Ack(false)
+		}
+
+		if settleErr != nil {
+			log.Printf("failed to settle delivery %d: %v", delivery.DeliveryTag, settleErr)
+		}
+
+		return err
+	}
+}
+
+func requestReconnect() {
+	select {
+	case reconnectRequests <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAcknowledge(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{Offset: 1}
+
+	tests := []struct {
+		name      string
+		err       error
+		acks      int
+		nacks     int
+		requeue   bool
+		reconnect bool
+	}{
+		{"handled", nil, 1, 0, false, false},
+		{"dropped", errors.New("unexpected status code 400"), 1, 0, false, false},
+		{"dead-lettered", syntaxErr, 0, 1, false, false},
+		{"reconnect", amqp.ErrClosed, 0, 1, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			select {
+			case <-reconnectRequests:
+			default:
+			}
+
+			ack := &fakeAcknowledger{}
+			handle := acknowledge(func(ctx context.Context, delivery amqp.Delivery) error {
+				return tt.err
+			})
+
+			if err := handle(context.Background(), amqp.Delivery{Acknowledger: ack}); !errors.Is(err, tt.err) {
+				t.Errorf("handler returned %v, want %v", err, tt.err)
+			}
+
+			if acks, nacks := ack.settled(); acks != tt.acks || nacks != tt.nacks || ack.requeue != tt.requeue {
+				t.Errorf("got %d acks, %d nacks (requeue %t), want %d, %d (requeue %t)", acks, nacks, ack.requeue, tt.acks, tt.nacks, tt.requeue)
+			}
+
+			reconnect := false
+			select {
+			case <-reconnectRequests:
+				reconnect = true
+			default:
+			}
+			if reconnect != tt.reconnect {
+				t.Errorf("reconnect requested: %t, want %t", reconnect, tt.reconnect)
+			}
+		})
+	}
+}
+
+// TestAcknowledgeFollowsOverrides checks ERROR_ACTIONS decides the settlement.
+func TestAcknowledgeFollowsOverrides(t *testing.T) {
+	if err := overrideErrorActions("decode=drop"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { errorActions = copyErrorActions(defaultErrorActions) })
+
+	ack := &fakeAcknowledger{}
+	handle := acknowledge(func(ctx context.Context, delivery amqp.Delivery) error {
+		return &json.SyntaxError{Offset: 1}
+	})
+	handle(context.Background(), amqp.Delivery{Acknowledger: ack})
+
+	if acks, nacks := ack.settled(); acks != 1 || nacks != 0 {
+		t.Errorf("got %d acks and %d nacks, want the dropped delivery acked", acks, nacks)
+	}
+}
+
+// TestAcknowledgeMixedBatch sends a batch with a valid report and a bad one and
+// checks it is acked, not dead-lettered, since the valid report was already
+// pushed, while a batch of bad reports only is still dead-lettered.
+func TestAcknowledgeMixedBatch(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{}
+	handle := acknowledge(sendMetrics)
+
+	valid := testMessage(t, "m1", start).Body
+	mixed := &fakeAcknowledger{}
+	err := handle(context.Background(), amqp.Delivery{Acknowledger: mixed, Body: []byte("[" + string(valid) + `,"not a report"]`)})
+	if !errors.Is(err, errPartialBatch) {
+		t.Errorf("mixed batch: err = %v, want errPartialBatch", err)
+	}
+
+	if acks, nacks := mixed.settled(); acks != 1 || nacks != 0 {
+		t.Errorf("mixed batch: got %d acks and %d nacks, want it acked", acks, nacks)
+	}
+	if got := len(gateway.pushed()); got != 1 {
+		t.Errorf("mixed batch: %d pushes, want the valid report pushed once", got)
+	}
+	if got := counterValue(t, droppedMessagesMetric.WithLabelValues("decode_failed")); got != 1 {
+		t.Errorf("mixed batch: decode_failed drops = %g, want 1", got)
+	}
+
+	bad := &fakeAcknowledger{}
+	handle(context.Background(), amqp.Delivery{Acknowledger: bad, Body: []byte(`["not a report",42]`)})
+	if acks, nacks := bad.settled(); acks != 0 || nacks != 1 || bad.requeue {
+		t.Errorf("bad batch: got %d acks and %d nacks (requeue %t), want it dead-lettered", acks, nacks, bad.requeue)
+	}
+}
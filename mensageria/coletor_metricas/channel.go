@@ -0,0 +1,11 @@
+package main
+
+import "broker"
+
+// channel is the subset of *amqp.Channel the collector uses, so the consume
+// loop can run against a fake channel feeding synthetic deliveries.
+type channel interface {
+	broker.Channel
+	deadLetterDeclarer
+	Cancel(consumer string, noWait bool) error
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+type errorAction string
+
+const (
+	actionRetry      errorAction = "retry"
+	actionDrop       errorAction = "drop"
+	actionDeadLetter errorAction = "dead-letter"
+	actionReconnect  errorAction = "reconnect"
+)
+
+type errorClass string
+
+const (
+	classAMQPConnectionClosed   errorClass = "amqp_connection_closed"
+	classAMQPChannelClosed      errorClass = "amqp_channel_closed"
+	classAMQPPreconditionFailed errorClass = "amqp_precondition_failed"
+	classAMQPAccessRefused      errorClass = "amqp_access_refused"
+	classAMQPNotFound           errorClass = "amqp_not_found"
+	classHTTPTimeout            errorClass = "http_timeout"
+	classHTTPClientError        errorClass = "http_4xx"
+	classHTTPServerError        errorClass = "http_5xx"
+	classDecode                 errorClass = "decode"
+	classMisrouted              errorClass = "misrouted"
+	classContentType            errorClass = "content_type"
+	classDecompress             errorClass = "decompress"
+	classSchema                 errorClass = "schema"
+	classUnknown                errorClass = "unknown"
+)
+
+var (
+	defaultErrorActions = map[errorClass]errorAction{
+		classAMQPConnectionClosed:   actionReconnect,
+		classAMQPChannelClosed:      actionReconnect,
+		classAMQPPreconditionFailed: actionDeadLetter,
+		classAMQPAccessRefused:      actionDrop,
+		classAMQPNotFound:           actionReconnect,
+		classHTTPTimeout:            actionRetry,
+		classHTTPClientError:        actionDrop,
+		classHTTPServerError:        actionRetry,
+		classDecode:                 actionDeadLetter,
+		classMisrouted:              actionDeadLetter,
+		classContentType:            actionDeadLetter,
+		classDecompress:             actionDeadLetter,
+		classSchema:                 actionDeadLetter,
+		classUnknown:                actionDrop,
+	}
+
+	errorActions = copyErrorActions(defaultErrorActions)
+
+	pushStatusCodeRegexp = regexp.MustCompile(`unexpected status code (\d{3})`)
+)
+
+func copyErrorActions(actions map[errorClass]errorAction) map[errorClass]errorAction {
+	c := make(map[errorClass]errorAction, len(actions))
+	for k, v := range actions {
+		c[k] = v
+	}
+
+	return c
+}
+
+// classifyError maps an AMQP or Pushgateway (HTTP) failure to one of the known
+// error classes. Anything it does not recognize is classUnknown.
+func classifyError(err error) errorClass {
+	if err == nil {
+		return classUnknown
+	}
+
+	if errors.Is(err, amqp.ErrClosed) {
+		return classAMQPConnectionClosed
+	}
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		switch amqpErr.Code {
+		case amqp.ConnectionForced, amqp.InternalError, amqp.FrameError:
+			return classAMQPConnectionClosed
+		case amqp.ChannelError, amqp.UnexpectedFrame, amqp.CommandInvalid:
+			return classAMQPChannelClosed
+		case amqp.PreconditionFailed:
+			return classAMQPPreconditionFailed
+		case amqp.AccessRefused:
+			return classAMQPAccessRefused
+		case amqp.NotFound:
+			return classAMQPNotFound
+		}
+
+		return classUnknown
+	}
+
+	if errors.Is(err, errMisrouted) {
+		return classMisrouted
+	}
+
+	if errors.Is(err, errUnexpectedContentType) {
+		return classContentType
+	}
+
+	if errors.Is(err, broker.ErrDecompress) {
+		return classDecompress
+	}
+
+	if errors.Is(err, broker.ErrSchemaValidation) {
+		return classSchema
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return classDecode
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return classHTTPTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return classHTTPTimeout
+	}
+
+	if m := pushStatusCodeRegexp.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		switch {
+		case code >= 500:
+			return classHTTPServerError
+		case code >= 400:
+			return classHTTPClientError
+		}
+	}
+
+	return classUnknown
+}
+
+func actionFor(err error) errorAction {
+	return errorActions[classifyError(err)]
+}
+
+// overrideErrorActions applies operator overrides on top of the built-in
+// table. The spec is a comma separated list of class=action pairs, e.g.
+// "http_4xx=retry,decode=drop".
+func overrideErrorActions(spec string) error {
+	actions := copyErrorActions(defaultErrorActions)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		class, action, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid error action override \"%s\": expected class=action", entry)
+		}
+
+		c := errorClass(strings.TrimSpace(class))
+		if _, ok := defaultErrorActions[c]; !ok {
+			return fmt.Errorf("invalid error action override \"%s\": unknown error class \"%s\"", entry, c)
+		}
+
+		a := errorAction(strings.TrimSpace(action))
+		switch a {
+		case actionRetry, actionDrop, actionDeadLetter, actionReconnect:
+		default:
+			return fmt.Errorf("invalid error action override \"%s\": unknown action \"%s\"", entry, a)
+		}
+
+		actions[c] = a
+	}
+
+	errorActions = actions
+	return nil
+}
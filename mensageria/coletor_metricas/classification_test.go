@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		class  errorClass
+		action errorAction
+	}{
+		{amqp.ErrClosed, classAMQPConnectionClosed, actionReconnect},
+		{&amqp.Error{Code: amqp.ConnectionForced}, classAMQPConnectionClosed, actionReconnect},
+		{&amqp.Error{Code: amqp.ChannelError}, classAMQPChannelClosed, actionReconnect},
+		{&amqp.Error{Code: amqp.PreconditionFailed}, classAMQPPreconditionFailed, actionDeadLetter},
+		{&amqp.Error{Code: amqp.AccessRefused}, classAMQPAccessRefused, actionDrop},
+		{&amqp.Error{Code: amqp.NotFound}, classAMQPNotFound, actionReconnect},
+		{&amqp.Error{Code: amqp.ResourceLocked}, classUnknown, actionDrop},
+		{context.DeadlineExceeded, classHTTPTimeout, actionRetry},
+		{fmt.Errorf("push: %w", timeoutError{}), classHTTPTimeout, actionRetry},
+		{errors.New("unexpected status code 404 while pushing"), classHTTPClientError, actionDrop},
+		{errors.New("unexpected status code 503 while pushing"), classHTTPServerError, actionRetry},
+		{&json.SyntaxError{Offset: 1}, classDecode, actionDeadLetter},
+		{&json.UnmarshalTypeError{Value: "string"}, classDecode, actionDeadLetter},
+		{errMisrouted, classMisrouted, actionDeadLetter},
+		{fmt.Errorf("%w \"text/plain\"", errUnexpectedContentType), classContentType, actionDeadLetter},
+		{fmt.Errorf("%w: gzip: invalid header", broker.ErrDecompress), classDecompress, actionDeadLetter},
+		{fmt.Errorf("%w: missing metadata", broker.ErrSchemaValidation), classSchema, actionDeadLetter},
+		{errors.New("something else"), classUnknown, actionDrop},
+		{nil, classUnknown, actionDrop},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.class), func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.class {
+				t.Errorf("classifyError(%v) = %s, want %s", tt.err, got, tt.class)
+			}
+
+			if got := actionFor(tt.err); got != tt.action {
+				t.Errorf("actionFor(%v) = %s, want %s", tt.err, got, tt.action)
+			}
+		})
+	}
+}
+
+func TestDefaultErrorActionsCoverEveryClass(t *testing.T) {
+	for class, action := range defaultErrorActions {
+		switch action {
+		case actionRetry, actionDrop, actionDeadLetter, actionReconnect:
+		default:
+			t.Errorf("class %s maps to unknown action %q", class, action)
+		}
+	}
+}
+
+func TestOverrideErrorActions(t *testing.T) {
+	t.Cleanup(func() { errorActions = copyErrorActions(defaultErrorActions) })
+
+	if err := overrideErrorActions("http_4xx=retry, decode = drop"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := actionFor(errors.New("unexpected status code 400")); got != actionRetry {
+		t.Errorf("http_4xx action = %s, want retry", got)
+	}
+	if got := actionFor(&json.SyntaxError{}); got != actionDrop {
+		t.Errorf("decode action = %s, want drop", got)
+	}
+	if got := actionFor(amqp.ErrClosed); got != actionReconnect {
+		t.Errorf("classes left out lost their default: got %s", got)
+	}
+
+	// Overrides always start from the defaults, not from the previous ones.
+	if err := overrideErrorActions(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := actionFor(&json.SyntaxError{}); got != actionDeadLetter {
+		t.Errorf("decode action = %s after resetting, want dead-letter", got)
+	}
+}
+
+func TestOverrideErrorActionsInvalid(t *testing.T) {
+	t.Cleanup(func() { errorActions = copyErrorActions(defaultErrorActions) })
+
+	for spec, want := range map[string]string{
+		"http_4xx":        "expected class=action",
+		"bogus=retry":     "unknown error class",
+		"http_4xx=ignore": "unknown action",
+	} {
+		err := overrideErrorActions(spec)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("overrideErrorActions(%q) = %v, want an error containing %q", spec, err, want)
+		}
+	}
+
+	if got := actionFor(errors.New("unexpected status code 400")); got != actionDrop {
+		t.Errorf("a rejected override changed the table: http_4xx action = %s", got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// TestConsumeDeliveries runs synthetic deliveries through the consumer and
+// worker pool the collector sets up, against a fake channel and a test
+// Pushgateway, and checks each machine is pushed under its own group.
+func TestConsumeDeliveries(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{}
+
+	ch := newFakeChannel()
+	if err := registerDLQ(ch, []string{"machines"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, tags, err := broker.ConsumeAll(ch, []string{"machines"}, broker.ConsumeOptions{Tag: "collector", QueueArgs: deadLetterArgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ch.queues["machines"]["x-dead-letter-exchange"]; got != "machines.dlx" {
+		t.Errorf("machines is declared with dead-letter exchange %v, want machines.dlx", got)
+	}
+
+	pool, err := broker.NewPool(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack := &fakeAcknowledger{}
+	go func() {
+		for _, machine := range []string{"m1", "m2"} {
+			delivery := testMessage(t, machine, start)
+			delivery.Acknowledger = ack
+			ch.deliveries <- delivery
+		}
+		ch.deliveries <- amqp.Delivery{Acknowledger: ack, Body: []byte("{not json")}
+		close(ch.deliveries)
+	}()
+
+	handle := newHandler()
+	for delivery := range msgs {
+		pool.Submit(context.Background(), handle, delivery)
+	}
+	pool.Close()
+
+	// The grouping labels are pushed in no particular order.
+	for _, machine := range []string{"m1", "m2"} {
+		group := "/machine_name/" + machine
+		if !slices.ContainsFunc(gateway.pushed(), func(path string) bool {
+			return strings.Contains(path, group) && strings.Contains(path, "/instance/replica-1")
+		}) {
+			t.Errorf("%s was not pushed under its group: %v", machine, gateway.pushed())
+		}
+	}
+
+	// The undecodable delivery is nacked without requeue, for the broker to
+	// route it to the dead-letter exchange.
+	if acks, nacks := ack.settled(); acks != 2 || nacks != 1 || ack.requeue {
+		t.Errorf("got %d acks and %d nacks (requeue %t), want 2 and 1 without requeue", acks, nacks, ack.requeue)
+	}
+
+	if err := cancelConsumers(ch, tags); err != nil || fmt.Sprint(ch.cancelled) != "[collector]" {
+		t.Errorf("cancelConsumers = %v, cancelled %v", err, ch.cancelled)
+	}
+}
+
+// TestConsumeAfterChannelClose simulates the broker closing the channel while
+// the connection stays up: the deliveries of the first channel stop, and the
+// reopened channel gets its dead-letter topology and consumer back.
+func TestConsumeAfterChannelClose(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	opts := broker.ConsumeOptions{Tag: "collector", ManualAck: true, QueueArgs: deadLetterArgs}
+
+	first := newFakeChannel()
+	if err := registerDLQ(first, []string{"machines"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := broker.ConsumeAll(first, []string{"machines"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(first.deliveries)
+	if _, ok := <-msgs; ok {
+		t.Fatal("a delivery was received from the closed channel")
+	}
+
+	reopened := newFakeChannel()
+	if err := registerDLQ(reopened, []string{"machines"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, tags, err := broker.ConsumeAll(reopened, []string{"machines"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(tags) != "[collector]" {
+		t.Errorf("consumer tags on the reopened channel = %v", tags)
+	}
+	if got := reopened.queues["machines"]["x-dead-letter-exchange"]; got != "machines.dlx" {
+		t.Errorf("machines is declared again with dead-letter exchange %v, want machines.dlx", got)
+	}
+	if fmt.Sprint(reopened.bindings) != fmt.Sprint(first.bindings) {
+		t.Errorf("the reopened channel has bindings %v, want %v", reopened.bindings, first.bindings)
+	}
+
+	ack := &fakeAcknowledger{}
+	go func() {
+		delivery := testMessage(t, "m1", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		delivery.Acknowledger = ack
+		reopened.deliveries <- delivery
+		close(reopened.deliveries)
+	}()
+
+	handle := newHandler()
+	for delivery := range msgs {
+		handle(context.Background(), delivery)
+	}
+
+	if acks, nacks := ack.settled(); acks != 1 || nacks != 0 {
+		t.Errorf("got %d acks and %d nacks on the reopened channel, want 1 ack", acks, nacks)
+	}
+}
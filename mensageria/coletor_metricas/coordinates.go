@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	coordinateModeCardinal = "cardinal"
+	coordinateModeSigned   = "signed"
+
+	defaultCardinalPointLabel = "cardinal_point"
+)
+
+var (
+	coordinateMode = coordinateModeCardinal
+
+	// cardinalPointLabel is CARDINAL_POINT_LABEL, the name of the label holding
+	// the cardinal point in cardinal mode.
+	cardinalPointLabel = defaultCardinalPointLabel
+)
+
+func parseCoordinateMode(value string) (string, error) {
+	switch value {
+	case "":
+		return coordinateModeCardinal, nil
+	case coordinateModeCardinal, coordinateModeSigned:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("invalid COORDINATE_MODE \"%s\": must be cardinal or signed", value)
+}
+
+// coordinateLabels are the labels of the latitude/longitude gauges: the
+// cardinal point in cardinal mode, none in signed mode.
+func coordinateLabels() []string {
+	if coordinateMode == coordinateModeSigned {
+		return []string{}
+	}
+
+	return []string{cardinalPointLabel}
+}
+
+// parseCardinalPointLabel validates CARDINAL_POINT_LABEL, e.g. "direction". It
+// may not take the name of a label the pushes are grouped by.
+func parseCardinalPointLabel(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return defaultCardinalPointLabel, nil
+	case !labelNameRegexp.MatchString(value) || strings.HasPrefix(value, "__"):
+		return "", fmt.Errorf("invalid CARDINAL_POINT_LABEL \"%s\": not a valid label name", value)
+	case value != defaultCardinalPointLabel && slices.Contains(reservedGroupingLabels, value):
+		return "", fmt.Errorf("invalid CARDINAL_POINT_LABEL \"%s\": the label is reserved", value)
+	}
+
+	return value, nil
+}
+
+// errMissingCoordinate is returned by parseCoordinate for an empty or
+// whitespace-only coordinate, which is skipped rather than counted as invalid.
+var errMissingCoordinate = errors.New("coordinate is missing")
+
+// parseCoordinate splits a "<degrees> <cardinal point>" coordinate such as
+// "23.5 S" into its numeric value and cardinal point. The cardinal point is
+// uppercased, so "23.5 s" ends up in the same series.
+func parseCoordinate(value string) (float64, string, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, "", errMissingCoordinate
+	}
+
+	fields := strings.Split(value, " ")
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("invalid coordinate \"%s\": expected \"<degrees> <cardinal point>\"", value)
+	}
+
+	degrees, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid coordinate \"%s\": %w", value, err)
+	}
+
+	return degrees, strings.ToUpper(fields[1]), nil
+}
+
+// signedCoordinate turns a "<degrees> <cardinal point>" pair into signed
+// degrees, where south and west are negative.
+func signedCoordinate(degrees float64, cardinalPoint string) float64 {
+	if cardinalPoint == "S" || cardinalPoint == "W" {
+		return -degrees
+	}
+
+	return degrees
+}
+
+// setCoordinate sets metric according to the coordinate mode. In both modes
+// only the positive and negative cardinal points of the axis are accepted, so
+// a typo cannot become a cardinal point label value of its own.
+func setCoordinate(metric *prometheus.GaugeVec, degrees float64, cardinalPoint, positive, negative string) error {
+	if cardinalPoint != positive && cardinalPoint != negative {
+		return fmt.Errorf("invalid cardinal point \"%s\": expected %s or %s", cardinalPoint, positive, negative)
+	}
+
+	switch {
+	case coordinateMode == coordinateModeCardinal:
+		metric.WithLabelValues(cardinalPoint).Set(degrees)
+	case cardinalPoint == positive:
+		metric.WithLabelValues().Set(degrees)
+	default:
+		metric.WithLabelValues().Set(-degrees)
+	}
+
+	return nil
+}
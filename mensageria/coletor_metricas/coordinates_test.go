@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseCoordinate(t *testing.T) {
+	tests := []struct {
+		value    string
+		degrees  float64
+		cardinal string
+		wantErr  bool
+	}{
+		{"23.5 S", 23.5, "S", false},
+		{"23.5 s", 23.5, "S", false},
+		{"46.6", 0, "", true},
+		{"abc N", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		degrees, cardinal, err := parseCoordinate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCoordinate(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+
+		if degrees != tt.degrees || cardinal != tt.cardinal {
+			t.Errorf("parseCoordinate(%q) = %g %q, want %g %q", tt.value, degrees, cardinal, tt.degrees, tt.cardinal)
+		}
+	}
+
+	if _, _, err := parseCoordinate("  "); !errors.Is(err, errMissingCoordinate) {
+		t.Errorf("parseCoordinate of a blank value = %v, want errMissingCoordinate", err)
+	}
+}
+
+// TestSetCoordinateWrongAxis covers a coordinate that parses but carries the
+// cardinal point of the other axis, e.g. a latitude of "10 E": it is rejected,
+// so the geohash is not built from it.
+func TestSetCoordinateWrongAxis(t *testing.T) {
+	for _, mode := range []string{coordinateModeCardinal, coordinateModeSigned} {
+		coordinateMode = mode
+		metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "latitude"}, coordinateLabels())
+
+		if err := setCoordinate(metric, 10, "E", "N", "S"); err == nil {
+			t.Errorf("%s mode: setCoordinate accepted an E latitude", mode)
+		}
+
+		if err := setCoordinate(metric, 10, "S", "N", "S"); err != nil {
+			t.Errorf("%s mode: setCoordinate rejected an S latitude: %v", mode, err)
+		}
+	}
+
+	coordinateMode = coordinateModeCardinal
+}
+
+func TestParseCoordinateMode(t *testing.T) {
+	for value, want := range map[string]string{"": coordinateModeCardinal, "cardinal": coordinateModeCardinal, "signed": coordinateModeSigned} {
+		if got, err := parseCoordinateMode(value); err != nil || got != want {
+			t.Errorf("parseCoordinateMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := parseCoordinateMode("decimal"); err == nil {
+		t.Error("parseCoordinateMode accepted \"decimal\"")
+	}
+}
+
+// TestSignedCoordinates checks the signed mode pushes label-less gauges with
+// south and west as negative degrees.
+func TestSignedCoordinates(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetricsMode(t, start, coordinateModeSigned)
+
+	send(t, testMessage(t, "m1", start))
+
+	families := machineFamilies(t, "m1")[categoryLocation]
+	for name, want := range map[string]float64{"latitude": -23.5, "longitude": -46.6} {
+		family := findFamily(families, name)
+		if family == nil || len(family.Metric) != 1 {
+			t.Fatalf("%s = %v, want a single series", name, family)
+		}
+
+		if labels := family.Metric[0].Label; len(labels) != 0 {
+			t.Errorf("%s is labeled %v, want no labels in signed mode", name, labels)
+		}
+		if got := family.Metric[0].GetGauge().GetValue(); got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+}
+
+// TestMissingOrMalformedLatitude sends messages with a latitude that is empty,
+// blank or garbage, and checks a missing one is skipped quietly while a
+// malformed one is logged and counted as invalid_coordinate. Either way the
+// rest of the message is still exported.
+func TestMissingOrMalformedLatitude(t *testing.T) {
+	tests := []struct {
+		latitude string
+		dropped  float64
+		logged   bool
+	}{
+		{"", 0, false},
+		{"   ", 0, false},
+		{"garbage", 1, true},
+		{"abc S", 1, true},
+	}
+
+	for _, tt := range tests {
+		setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+		var out bytes.Buffer
+		log.SetOutput(&out)
+
+		var msg Message
+		msg.Metadata.Name = "m1"
+		msg.Metrics.Coordinates = Coordinates{Latitude: tt.latitude, Longitude: "46.6 W"}
+		msg.Metrics.Temperature = 300
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendErr := sendMetrics(context.Background(), amqp.Delivery{Body: body})
+		log.SetOutput(os.Stderr)
+
+		if sendErr != nil {
+			t.Errorf("latitude %q: sendMetrics = %v", tt.latitude, sendErr)
+		}
+
+		if got := counterValue(t, droppedMessagesMetric.WithLabelValues("invalid_coordinate")); got != tt.dropped {
+			t.Errorf("latitude %q: invalid_coordinate drops = %g, want %g", tt.latitude, got, tt.dropped)
+		}
+
+		if logged := strings.Contains(out.String(), "invalid latitude coordinate"); logged != tt.logged {
+			t.Errorf("latitude %q: logged the invalid coordinate %t, want %t:\n%s", tt.latitude, logged, tt.logged, out.String())
+		}
+
+		families := machineFamilies(t, "m1")
+		if family := findFamily(families[categoryLocation], "latitude"); family != nil && len(family.Metric) > 0 {
+			t.Errorf("latitude %q exported %v", tt.latitude, family.Metric)
+		}
+		if family := findFamily(families[categoryLocation], "longitude"); family == nil || len(family.Metric) != 1 {
+			t.Errorf("latitude %q: the longitude was not exported", tt.latitude)
+		}
+	}
+}
+
+// sendCoordinates sends a message of m1 with the given coordinates.
+func sendCoordinates(t *testing.T, latitude, longitude string) error {
+	t.Helper()
+
+	var msg Message
+	msg.Metadata.Name = "m1"
+	msg.Metrics.Coordinates = Coordinates{Latitude: latitude, Longitude: longitude}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sendMetrics(context.Background(), amqp.Delivery{Body: body})
+}
+
+// labelValue is the value of the label name of the single series of family.
+func labelValue(t *testing.T, family *dto.MetricFamily, name string) string {
+	t.Helper()
+
+	if family == nil || len(family.Metric) != 1 {
+		t.Fatalf("want a single series, got %v", family)
+	}
+
+	for _, label := range family.Metric[0].Label {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+
+	t.Fatalf("%s has no %s label: %v", family.GetName(), name, family.Metric[0].Label)
+	return ""
+}
+
+// TestCardinalPointCase checks lowercase cardinal points end up in the same
+// uppercase series, and that a cardinal point off the axis, or not one at
+// all, is dropped and counted.
+func TestCardinalPointCase(t *testing.T) {
+	tests := []struct {
+		latitude, longitude string
+		wantLatitude        string
+		wantLongitude       string
+		dropped             float64
+	}{
+		{"23.5 s", "46.6 w", "S", "W", 0},
+		{"23.5 n", "46.6 e", "N", "E", 0},
+		{"23.5 X", "46.6 W", "", "W", 1},
+		{"23.5 E", "46.6 n", "", "", 2},
+	}
+
+	for _, tt := range tests {
+		setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		if err := sendCoordinates(t, tt.latitude, tt.longitude); err != nil {
+			t.Fatalf("sendMetrics: %v", err)
+		}
+
+		families := machineFamilies(t, "m1")[categoryLocation]
+		for _, c := range []struct{ name, want string }{{"latitude", tt.wantLatitude}, {"longitude", tt.wantLongitude}} {
+			family := findFamily(families, c.name)
+			if c.want == "" {
+				if family != nil && len(family.Metric) > 0 {
+					t.Errorf("%q %q: the invalid %s was exported: %v", tt.latitude, tt.longitude, c.name, family.Metric)
+				}
+				continue
+			}
+
+			if got := labelValue(t, family, cardinalPointLabel); got != c.want {
+				t.Errorf("%q %q: %s cardinal point = %q, want %q", tt.latitude, tt.longitude, c.name, got, c.want)
+			}
+		}
+
+		if got := counterValue(t, droppedMessagesMetric.WithLabelValues("invalid_cardinal_point")); got != tt.dropped {
+			t.Errorf("%q %q: invalid_cardinal_point drops = %g, want %g", tt.latitude, tt.longitude, got, tt.dropped)
+		}
+	}
+}
+
+func TestParseCardinalPointLabel(t *testing.T) {
+	for value, want := range map[string]string{"": defaultCardinalPointLabel, " direction ": "direction", defaultCardinalPointLabel: defaultCardinalPointLabel} {
+		if got, err := parseCardinalPointLabel(value); err != nil || got != want {
+			t.Errorf("parseCardinalPointLabel(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"1direction", "cardinal-point", "__direction", "machine_name", "instance", "geohash"} {
+		if _, err := parseCardinalPointLabel(value); err == nil {
+			t.Errorf("parseCardinalPointLabel(%q) was accepted", value)
+		}
+	}
+}
+
+// TestCardinalPointLabelName checks the coordinates are exported under the
+// label CARDINAL_POINT_LABEL names.
+func TestCardinalPointLabelName(t *testing.T) {
+	cardinalPointLabel = "direction"
+	t.Cleanup(func() { cardinalPointLabel = defaultCardinalPointLabel })
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	if err := sendCoordinates(t, "23.5 S", "46.6 W"); err != nil {
+		t.Fatalf("sendMetrics: %v", err)
+	}
+
+	families := machineFamilies(t, "m1")[categoryLocation]
+	for name, want := range map[string]string{"latitude": "S", "longitude": "W"} {
+		family := findFamily(families, name)
+		if got := labelValue(t, family, "direction"); got != want {
+			t.Errorf("%s direction = %q, want %q", name, got, want)
+		}
+
+		for _, label := range family.Metric[0].Label {
+			if label.GetName() == defaultCardinalPointLabel {
+				t.Errorf("%s still carries the %s label", name, defaultCardinalPointLabel)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+var (
+	deadLetterExchange string
+	deadLetterQueue    string
+)
+
+// deadLetterDeclarer is the subset of *amqp.Channel used by registerDLQ.
+type deadLetterDeclarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// deadLetterNames returns the dead-letter exchange and queue of queue:
+// DEAD_LETTER_EXCHANGE and DEAD_LETTER_QUEUE when set, "<queue>.dlx" and
+// "<queue>.dlq" otherwise.
+func deadLetterNames(queue string) (string, string) {
+	exchange, dlq := deadLetterExchange, deadLetterQueue
+	if exchange == "" {
+		exchange = queue + ".dlx"
+	}
+	if dlq == "" {
+		dlq = queue + ".dlq"
+	}
+
+	return exchange, dlq
+}
+
+// deadLetterArgs is the broker.ConsumeOptions.QueueArgs routing rejected
+// deliveries of queue to its dead-letter exchange.
+func deadLetterArgs(queue string) amqp.Table {
+	exchange, _ := deadLetterNames(queue)
+	return amqp.Table{"x-dead-letter-exchange": exchange}
+}
+
+// registerDLQ declares a durable fanout dead-letter exchange for each queue
+// and binds its durable dead-letter queue to it. It has to run before the
+// queues themselves are declared with deadLetterArgs.
+func registerDLQ(ch deadLetterDeclarer, queues []string) error {
+	for _, queue := range queues {
+		exchange, dlq := deadLetterNames(queue)
+
+		if err := ch.ExchangeDeclare(exchange, "fanout", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("%w \"%s\" for dead letters: %w", broker.ErrExchangeDeclare, exchange, err)
+		}
+
+		if _, err := ch.QueueDeclare(dlq, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("%w \"%s\" for dead letters: %w", broker.ErrQueueDeclare, dlq, err)
+		}
+
+		if err := ch.QueueBind(dlq, "", exchange, false, nil); err != nil {
+			return fmt.Errorf("%w \"%s\" to dead-letter exchange \"%s\": %w", broker.ErrQueueBind, dlq, exchange, err)
+		}
+	}
+
+	return nil
+}
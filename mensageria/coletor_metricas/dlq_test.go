@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegisterDLQ(t *testing.T) {
+	ch := newFakeChannel()
+	if err := registerDLQ(ch, []string{"machines"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(ch.exchanges) != "[machines.dlx (fanout)]" {
+		t.Errorf("declared exchanges %v", ch.exchanges)
+	}
+
+	if _, ok := ch.queues["machines.dlq"]; !ok {
+		t.Errorf("machines.dlq was not declared: %v", ch.queues)
+	}
+
+	if fmt.Sprint(ch.bindings) != "[machines.dlx -> machines.dlq]" {
+		t.Errorf("bindings %v", ch.bindings)
+	}
+}
+
+func TestDeadLetterNames(t *testing.T) {
+	if exchange, queue := deadLetterNames("machines"); exchange != "machines.dlx" || queue != "machines.dlq" {
+		t.Errorf("default names = %s, %s", exchange, queue)
+	}
+
+	deadLetterExchange, deadLetterQueue = "dlx", "dlq"
+	t.Cleanup(func() { deadLetterExchange, deadLetterQueue = "", "" })
+
+	if exchange, queue := deadLetterNames("machines"); exchange != "dlx" || queue != "dlq" {
+		t.Errorf("configured names = %s, %s", exchange, queue)
+	}
+
+	if got := deadLetterArgs("machines")["x-dead-letter-exchange"]; got != "dlx" {
+		t.Errorf("x-dead-letter-exchange = %v, want dlx", got)
+	}
+}
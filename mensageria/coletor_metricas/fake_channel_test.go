@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeChannel stands in for *amqp.Channel: it records the queues and
+// exchanges declared, with their arguments, and feeds the deliveries sent to
+// its deliveries channel to every consumer.
+type fakeChannel struct {
+	mu        sync.Mutex
+	queues    map[string]amqp.Table
+	exchanges []string
+	bindings  []string
+	cancelled []string
+
+	deliveries chan amqp.Delivery
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{queues: map[string]amqp.Table{}, deliveries: make(chan amqp.Delivery)}
+}
+
+func (f *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.queues[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.exchanges = append(f.exchanges, name+" ("+kind+")")
+	return nil
+}
+
+func (f *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.bindings = append(f.bindings, exchange+" -> "+name)
+	return nil
+}
+
+func (f *fakeChannel) Cancel(consumer string, noWait bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cancelled = append(f.cancelled, consumer)
+	return nil
+}
+
+// fakeAcknowledger records how deliveries were settled.
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	acks    int
+	nacks   int
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (a *fakeAcknowledger) settled() (acks, nacks int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.acks, a.nacks
+}
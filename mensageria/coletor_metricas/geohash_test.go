@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		latitude, longitude float64
+		precision           int
+		want                string
+	}{
+		{42.605, -5.603, 5, "ezs42"},
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{-23.5505, -46.6333, 6, "6gyf4b"},
+		{0, 0, 1, "s"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeGeohash(tt.latitude, tt.longitude, tt.precision); got != tt.want {
+			t.Errorf("encodeGeohash(%g, %g, %d) = %q, want %q", tt.latitude, tt.longitude, tt.precision, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// finalInstancePushTimeout bounds the last push of the instance metrics on
+// shutdown, which happens after the grace period, so it fits within the
+// default SHUTDOWN_TIMEOUT.
+const finalInstancePushTimeout = 2 * time.Second
+
+var (
+	// instanceRegistry holds the metrics of the collector itself, such as the
+	// heartbeat and service_ready. It is kept apart from the category
+	// registries: these metrics are grouped by the collector instance rather
+	// than by the machine of the last message, so they are pushed by their own
+	// pusher.
+	instanceRegistry = prometheus.NewRegistry()
+	instancePusher   *push.Pusher
+
+	// instancePushRequests asks instancePushLoop for a push. Its buffer of one
+	// folds the requests made while a push is in flight into the next push.
+	instancePushRequests = make(chan struct{}, 1)
+
+	collectorUpMetric       prometheus.Gauge
+	lastHeartbeatTimeMetric prometheus.Gauge
+)
+
+func registerInstanceMetrics(namespace string) {
+	collectorUpMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "collector_up",
+			Help:      "always 1, pushed on every heartbeat so a silent collector shows up as a stale group",
+			Namespace: namespace,
+		},
+	)
+
+	lastHeartbeatTimeMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "collector_last_heartbeat_timestamp_seconds",
+			Help:      "unix time of the last heartbeat pushed by the collector",
+			Namespace: namespace,
+		},
+	)
+
+	instanceRegistry.MustRegister(collectorUpMetric)
+	instanceRegistry.MustRegister(lastHeartbeatTimeMetric)
+}
+
+// defaultInstanceID is the collector hostname, or "unknown" when it cannot be
+// read.
+func defaultInstanceID() string {
+	instance, err := os.Hostname()
+	if err != nil || instance == "" {
+		return "unknown"
+	}
+
+	return instance
+}
+
+// newInstancePusher pushes the instance metrics under job, grouped by instance
+// and the EXTRA_LABELS.
+func newInstancePusher(url, job, instance string, extraLabels map[string]string) *push.Pusher {
+	p := newPusher(url, job).Gatherer(instanceRegistry).Grouping("instance", instance)
+	for name, value := range extraLabels {
+		p = p.Grouping(name, value)
+	}
+
+	return p
+}
+
+// requestInstancePush asks for a push of the instance metrics without waiting
+// for it, e.g. right after a readiness transition.
+func requestInstancePush() {
+	select {
+	case instancePushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// instancePushLoop pushes the instance metrics on every tick of the heartbeat
+// and every requestInstancePush until ctx is done. It runs in its own
+// goroutine, so a slow Pushgateway never holds up the main loop, and it is the
+// only one pushing instancePusher, so at most one push is in flight: the
+// requests and ticks that fall while it is busy end up in a single next push.
+func instancePushLoop(ctx context.Context, heartbeat <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat:
+		case <-instancePushRequests:
+		}
+
+		if err := pushInstance(ctx); err != nil {
+			log.Printf("failed to push instance metrics (%s): %v", actionFor(err), err)
+		}
+	}
+}
+
+// startInstancePush runs instancePushLoop until the returned stop is called.
+// stop waits for the loop to return and pushes the instance metrics one last
+// time, so the group is left with service_ready at 0 rather than at the value
+// of the last push.
+func startInstancePush(heartbeat <-chan time.Time) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		instancePushLoop(ctx, heartbeat)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+
+		ctx, cancel := context.WithTimeout(context.Background(), finalInstancePushTimeout)
+		defer cancel()
+		if err := pushInstance(ctx); err != nil {
+			log.Printf("failed to push instance metrics (%s): %v", actionFor(err), err)
+		}
+	}
+}
+
+// pushInstance only touches instancePusher and its registry, so it cannot
+// race with the per-message pushes made by the workers. The instance metrics
+// are stored in the scrape cache too, under the instance alone.
+func pushInstance(ctx context.Context) error {
+	collectorUpMetric.Set(1)
+	lastHeartbeatTimeMetric.Set(float64(now().Unix()))
+
+	if scrape != nil {
+		families, err := instanceRegistry.Gather()
+		if err != nil {
+			return err
+		}
+		scrape.store(map[string]string{"instance": instanceID}, map[string][]*dto.MetricFamily{categoryCustom: families})
+	}
+
+	if !pushEnabled {
+		return nil
+	}
+
+	done := operations.Start("push of instance metrics")
+	defer done()
+
+	return pushWithRetry(ctx, instancePusher)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"broker"
+)
+
+// testPushgateway records the paths pushed to it. Each push is held for delay,
+// and the highest number of pushes in flight at once is kept in maxInFlight.
+type testPushgateway struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	paths       []string
+	inFlight    int
+	maxInFlight int
+}
+
+func newTestPushgateway(t *testing.T, delay time.Duration) *testPushgateway {
+	t.Helper()
+
+	g := &testPushgateway{}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		g.paths = append(g.paths, r.Method+" "+r.URL.Path)
+		g.inFlight++
+		g.maxInFlight = max(g.maxInFlight, g.inFlight)
+		g.mu.Unlock()
+
+		time.Sleep(delay)
+
+		g.mu.Lock()
+		g.inFlight--
+		g.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+func (g *testPushgateway) pushed() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]string(nil), g.paths...)
+}
+
+// waitPushes waits until the gateway received n pushes.
+func (g *testPushgateway) waitPushes(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if paths := g.pushed(); len(paths) >= n {
+			return paths
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("got %d pushes, want %d", len(g.pushed()), n)
+	return nil
+}
+
+// TestInstancePushLoop checks the heartbeat is pushed off the caller's
+// goroutine, grouped by instance, and never with two pushes in flight.
+func TestInstancePushLoop(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 20*time.Millisecond)
+	instancePusher = newInstancePusher(gateway.URL, "job", instanceID, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	heartbeat := make(chan time.Time, 3)
+	go instancePushLoop(ctx, heartbeat)
+	for range 3 {
+		heartbeat <- time.Now()
+	}
+
+	paths := gateway.waitPushes(t, 3)
+	if paths[0] != "POST /metrics/job/job/instance/replica-1" {
+		t.Errorf("heartbeat pushed to %q", paths[0])
+	}
+
+	if got := gaugeValue(t, lastHeartbeatTimeMetric); got != float64(start.Unix()) {
+		t.Errorf("last heartbeat = %g, want %d", got, start.Unix())
+	}
+
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.maxInFlight != 1 {
+		t.Errorf("%d instance pushes were in flight at once, want 1", gateway.maxInFlight)
+	}
+}
+
+// TestReadinessIsPushed checks service_ready tracks the readiness transitions
+// and that each transition is pushed without waiting for a message or the
+// heartbeat, including the last one on shutdown.
+func TestReadinessIsPushed(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	pushEnabled = true
+	scrape = newScrapeCache()
+	gateway := newTestPushgateway(t, 0)
+	instancePusher = newInstancePusher(gateway.URL, "job", instanceID, nil)
+
+	stop := startInstancePush(nil)
+
+	setReady(true)
+	gateway.waitPushes(t, 1)
+	if got := scrapedValue(t, "service_ready"); got != 1 {
+		t.Errorf("service_ready = %g after setReady(true), want 1", got)
+	}
+
+	setReady(false)
+	stop()
+	if got := scrapedValue(t, "service_ready"); got != 0 {
+		t.Errorf("service_ready = %g after setReady(false), want 0", got)
+	}
+
+	if paths := gateway.pushed(); len(paths) < 2 {
+		t.Errorf("got %d pushes, want the readiness pushed on both transitions", len(paths))
+	}
+}
+
+func TestConnectionStateIsPushed(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	setConnectionState(broker.State{Connected: false, ChannelOpen: false})
+	select {
+	case <-instancePushRequests:
+	default:
+		t.Error("a connection state change did not request a push")
+	}
+
+	if got := gaugeValue(t, rabbitmqConnectedMetric); got != 0 {
+		t.Errorf("rabbitmq_connected = %g, want 0", got)
+	}
+}
+
+// TestConnectionStateGauges drives the collector through a connect, a channel
+// closed under a live connection and a disconnect, and checks the gauges
+// follow each transition.
+func TestConnectionStateGauges(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name  string
+		state broker.State
+		want  [3]float64
+	}{
+		{"connected", broker.State{Connected: true, ChannelOpen: true}, [3]float64{1, 1, 1}},
+		{"channel closed", broker.State{Connected: true, ChannelOpen: false}, [3]float64{1, 1, 0}},
+		{"disconnected", broker.State{}, [3]float64{0, 0, 0}},
+		{"reconnected", broker.State{Connected: true, ChannelOpen: true}, [3]float64{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		setConnectionState(tt.state)
+		<-instancePushRequests
+
+		got := [3]float64{
+			gaugeValue(t, amqpConnectedMetric),
+			gaugeValue(t, rabbitmqConnectedMetric),
+			gaugeValue(t, amqpChannelOpenMetric),
+		}
+		if got != tt.want {
+			t.Errorf("%s: amqp_connected, rabbitmq_connected, amqp_channel_open = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRabbitMQConnectedIsServed checks rabbitmq_connected reaches the scrape
+// without the collector namespace, so one alert rule covers both services, and
+// follows a disconnect and the reconnect after it.
+func TestRabbitMQConnectedIsServed(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	scrape = newScrapeCache()
+
+	for _, state := range []broker.State{{Connected: true, ChannelOpen: true}, {}, {Connected: true, ChannelOpen: true}} {
+		setConnectionState(state)
+		if err := pushInstance(context.Background()); err != nil {
+			t.Fatalf("pushInstance: %v", err)
+		}
+
+		families, err := scrape.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var family *dto.MetricFamily
+		for _, f := range families {
+			if f.GetName() == "rabbitmq_connected" {
+				family = f
+			}
+		}
+		if family == nil || len(family.Metric) != 1 {
+			t.Fatalf("rabbitmq_connected is missing from the scrape: %v", family)
+		}
+
+		want := boolToFloat(state.Connected)
+		if got := family.Metric[0].GetGauge().GetValue(); got != want {
+			t.Errorf("rabbitmq_connected = %g with %+v, want %g", got, state, want)
+		}
+	}
+}
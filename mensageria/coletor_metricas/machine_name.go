@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// machineNameTransform rewrites the machine name of every message before it is
+// used as the machine_name grouping key. The zero value leaves names unchanged.
+type machineNameTransform struct {
+	prefix  string
+	suffix  string
+	pattern *regexp.Regexp
+}
+
+// parseMachineNameTransform reads MACHINE_NAME_TRIM_PREFIX,
+// MACHINE_NAME_TRIM_SUFFIX and MACHINE_NAME_PATTERN. The pattern must have
+// exactly one capture group, whose match becomes the name.
+func parseMachineNameTransform(prefix, suffix, pattern string) (machineNameTransform, error) {
+	t := machineNameTransform{prefix: prefix, suffix: suffix}
+	if pattern == "" {
+		return t, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return machineNameTransform{}, fmt.Errorf("failed to parse MACHINE_NAME_PATTERN: %w", err)
+	}
+
+	if re.NumSubexp() != 1 {
+		return machineNameTransform{}, fmt.Errorf("invalid MACHINE_NAME_PATTERN \"%s\": must have exactly one capture group", pattern)
+	}
+
+	t.pattern = re
+	return t, nil
+}
+
+// apply trims the prefix and suffix, then extracts the capture group of the
+// pattern. Names the pattern does not match, or that would end up empty, are
+// kept as they came after trimming, so an unexpected name is still pushed.
+// With the prefix "prod." and the suffix ".internal", for instance,
+// "prod.machine-042.internal" becomes "machine-042".
+func (t machineNameTransform) apply(name string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(name, t.prefix), t.suffix)
+	if trimmed == "" {
+		trimmed = name
+	}
+
+	if t.pattern == nil {
+		return trimmed
+	}
+
+	m := t.pattern.FindStringSubmatch(trimmed)
+	if m == nil || m[1] == "" {
+		return trimmed
+	}
+
+	return m[1]
+}
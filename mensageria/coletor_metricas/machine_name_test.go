@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMachineNameTransform(t *testing.T) {
+	if _, err := parseMachineNameTransform("", "", `machine-\d+`); err == nil {
+		t.Error("a pattern without a capture group was accepted")
+	}
+
+	if _, err := parseMachineNameTransform("", "", `(machine)-(\d+)`); err == nil {
+		t.Error("a pattern with two capture groups was accepted")
+	}
+
+	if _, err := parseMachineNameTransform("", "", `(machine`); err == nil {
+		t.Error("an invalid pattern was accepted")
+	}
+
+	if _, err := parseMachineNameTransform("prod.", ".internal", `(machine-\d+)`); err != nil {
+		t.Errorf("parseMachineNameTransform: %v", err)
+	}
+}
+
+func TestMachineNameTransformApply(t *testing.T) {
+	tests := []struct {
+		prefix, suffix, pattern string
+		name                    string
+		want                    string
+	}{
+		// No transform configured.
+		{"", "", "", "prod.machine-042.internal", "prod.machine-042.internal"},
+
+		{"prod.", ".internal", "", "prod.machine-042.internal", "machine-042"},
+		{"prod.", "", "", "prod.machine-042.internal", "machine-042.internal"},
+		{"", ".internal", "", "prod.machine-042.internal", "prod.machine-042"},
+
+		// Names the trim does not match pass through.
+		{"prod.", ".internal", "", "staging.machine-042.local", "staging.machine-042.local"},
+
+		// A trim that would leave nothing keeps the name.
+		{"prod.", "", "", "prod.", "prod."},
+
+		{"", "", `\.(machine-\d+)\.`, "prod.machine-042.internal", "machine-042"},
+		{"prod.", "", `^(machine-\d+)`, "prod.machine-042.internal", "machine-042"},
+
+		// Names the pattern does not match pass through, after the trim.
+		{"", "", `(machine-\d+)`, "sensor-7", "sensor-7"},
+		{"prod.", "", `^(machine-\d+)$`, "prod.gateway", "gateway"},
+
+		// An empty capture keeps the trimmed name.
+		{"", "", `machine-(\d*)x`, "machine-x", "machine-x"},
+	}
+
+	for _, tt := range tests {
+		transform, err := parseMachineNameTransform(tt.prefix, tt.suffix, tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := transform.apply(tt.name); got != tt.want {
+			t.Errorf("prefix %q, suffix %q, pattern %q: apply(%q) = %q, want %q", tt.prefix, tt.suffix, tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSendMetricsMachineNameTransform checks the transformed name is the one
+// pushed as the machine_name grouping key.
+func TestSendMetricsMachineNameTransform(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{}
+
+	transform, err := parseMachineNameTransform("prod.", ".internal", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machineName = transform
+	t.Cleanup(func() { machineName = machineNameTransform{} })
+
+	send(t, testMessage(t, "prod.machine-042.internal", start))
+
+	paths := gateway.pushed()
+	if len(paths) == 0 {
+		t.Fatal("nothing was pushed")
+	}
+	for _, path := range paths {
+		if !strings.Contains(path, "/machine_name/machine-042/") && !strings.HasSuffix(path, "/machine_name/machine-042") {
+			t.Errorf("pushed to %s, want the trimmed machine name", path)
+		}
+	}
+}
@@ -1,86 +1,105 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"broker"
 )
 
 const (
-	metricsNamespace = "machines_monitoring"
+	consumerTagPrefix = "collector"
+
+	defaultShutdownGracePeriod = 5 * time.Second
+	defaultShutdownTimeout     = 10 * time.Second
+	defaultReconnectBackoff    = time.Second
+	defaultReconnectMaxBackoff = 30 * time.Second
+	defaultPrefetchCount       = 10
+	defaultWorkerCount         = 1
+	defaultParseRatioWindow    = 5 * time.Minute
+	defaultGeohashPrecision    = 7
+	defaultMaxMessageBytes     = 1 << 20
+	parseRatioWindowBuckets    = 30
 )
 
 var (
-	registry = prometheus.NewRegistry()
-	pusher   = push.New(fmt.Sprintf("%s:%s", os.Getenv("PROMETHEUS_PUSHGATEWAY_HOST"), os.Getenv("PROMETHEUS_PUSHGATEWAY_PORT")), "machines_monitoring").Gatherer(registry)
-
-	latitudeMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "latitude",
-			Help:      "latitude coordinate of machine",
-			Namespace: metricsNamespace,
-		},
-		[]string{"cardinal_point"},
-	)
-
-	longitudeMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "longitude",
-			Help:      "longitude coordinate of machine",
-			Namespace: metricsNamespace,
-		},
-		[]string{"cardinal_point"},
-	)
-
-	temperatureMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "temperature",
-			Help:      "temperature of machine",
-			Namespace: metricsNamespace,
-		},
-		[]string{},
-	)
-
-	cpuUsagePorcMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "cpu_usage_porc",
-			Help:      "cpu usage of machine in porcentage (0.0 - 1.0)",
-			Namespace: metricsNamespace,
-		},
-		[]string{},
-	)
-
-	memUsagePorcMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "mem_usage_porc",
-			Help:      "memory usage of machine in porcentage (0.0 - 1.0)",
-			Namespace: metricsNamespace,
-		},
-		[]string{},
-	)
-
-	memUsageBytesMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:      "mem_usage_bytes",
-			Help:      "memory usage of machine in bytes",
-			Namespace: metricsNamespace,
-		},
-		[]string{},
-	)
+	debug               bool
+	parseRatioWindow    *ratioWindow
+	exportGeohash       bool
+	maxFutureSkew       time.Duration
+	maxMessageAge       time.Duration
+	geohashPrecision    int
+	maxMessageBytes     int
+	expectedContentType string
+	messageSchema       *broker.Schema
+	machineName         machineNameTransform
+	workerCount         int
+	lastMessageAt       = map[string]time.Time{}
+	tracer              = otel.Tracer("coletor-metricas")
+	reconnectBackoff    broker.Backoff
+	operations          = broker.NewOperations()
 )
 
+var configEnvVars = append([]string{
+	"RABBITMQ_QUEUE",
+	"DEBUG",
+	"METRICS_NAMESPACE",
+	"COORDINATE_MODE",
+	"CARDINAL_POINT_LABEL",
+	"PUSH_JOB",
+	"PUSH_JOBS",
+	"PROMETHEUS_PUSHGATEWAY_HOST",
+	"PROMETHEUS_PUSHGATEWAY_PORT",
+	"ERROR_ACTIONS",
+	"SHUTDOWN_GRACE_PERIOD",
+	"SHUTDOWN_TIMEOUT",
+	"WORKER_COUNT",
+	"HEARTBEAT_INTERVAL",
+	"PARSE_RATIO_WINDOW",
+	"EXPORT_GEOHASH",
+	"GEOHASH_PRECISION",
+	"PUSH_MAX_RETRIES",
+	"PUSH_BACKOFF",
+	"PUSH_HTTP_TIMEOUT",
+	"PUSHGATEWAY_USERNAME",
+	"PUSHGATEWAY_PASSWORD",
+	"PUSH_HEADERS",
+	"MAX_FUTURE_SKEW",
+	"MAX_MESSAGE_AGE",
+	"MAX_MESSAGE_BYTES",
+	"EXPECT_CONTENT_TYPE",
+	"MACHINE_NAME_TRIM_PREFIX",
+	"MACHINE_NAME_TRIM_SUFFIX",
+	"MACHINE_NAME_PATTERN",
+	"TEMPERATURE_UNIT",
+	"METRICS_PORT",
+	"PUSH_ENABLED",
+	"INSTANCE_ID",
+	"RABBITMQ_MANAGEMENT_URL",
+	"RABBITMQ_MANAGEMENT_USERNAME",
+	"RABBITMQ_MANAGEMENT_PASSWORD",
+	"QUEUE_DEPTH_INTERVAL",
+	"EXTRA_LABELS",
+	"DEAD_LETTER_EXCHANGE",
+	"DEAD_LETTER_QUEUE",
+}, broker.EnvVars...)
+
 type Metadata struct {
-	Name string `json:"name"`
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
 }
 
 type Coordinates struct {
@@ -92,8 +111,9 @@ type Metrics struct {
 	Coordinates   Coordinates `json:"coordinates"`
 	Temperature   float64     `json:"temperature"`
 	CPUUsagePorc  float64     `json:"cpu_usage_porc"`
+	CPUCores      []float64   `json:"cpu_cores,omitempty"`
 	MemUsagePorc  float64     `json:"mem_usage_porc"`
-	MemUsageBytes int         `json:"mem_usage_bytes"`
+	MemUsageBytes int64       `json:"mem_usage_bytes"`
 }
 
 type Message struct {
@@ -101,129 +121,691 @@ type Message struct {
 	Metrics  Metrics  `json:"metrics"`
 }
 
-func init() {
-	registry.MustRegister(latitudeMetric)
-	registry.MustRegister(longitudeMetric)
-	registry.MustRegister(temperatureMetric)
-	registry.MustRegister(cpuUsagePorcMetric)
-	registry.MustRegister(memUsagePorcMetric)
-	registry.MustRegister(memUsageBytesMetric)
+// setReady records a readiness transition and pushes it right away, since the
+// next message, which would otherwise push it, may never come.
+func setReady(v bool) {
+	serviceReadyMetric.Set(boolToFloat(v))
+	requestInstancePush()
 }
 
 func main() {
-	username := os.Getenv("RABBITMQ_USERNAME")
-	password := os.Getenv("RABBITMQ_PASSWORD")
-	host := os.Getenv("RABBITMQ_HOST")
-	port := os.Getenv("RABBITMQ_PORT")
-	queue := os.Getenv("RABBITMQ_QUEUE")
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%s/", username, password, host, port))
+	if err := broker.ParseFlags(configEnvVars); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	switch broker.Command() {
+	case "":
+	case "ping":
+		cfg, err := broker.ConfigFromEnv()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if err := broker.Ping(cfg); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case "replay":
+		if len(broker.CommandArgs()) != 1 {
+			log.Fatal("usage: replay <file.ndjson>")
+		}
+
+		cfg, err := broker.ConfigFromEnv()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		opts, err := broker.ReplayOptionsFromEnv(broker.ParseQueues(os.Getenv("RABBITMQ_QUEUE")))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if err := broker.ReplayFile(cfg, broker.CommandArgs()[0], opts); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	default:
+		log.Fatalf("unknown command \"%s\"", broker.Command())
+	}
+	broker.LogBuildInfo("coletor-metricas")
+	broker.LogConfig(configEnvVars)
+
+	var err error
+	debug, err = parseBool("DEBUG", false)
 	if err != nil {
-		log.Fatalf("failed to connect to rabbitmq: %v", err)
+		log.Fatal(err.Error())
 	}
 
-	ch, err := conn.Channel()
+	namespace := getEnv("METRICS_NAMESPACE", defaultMetricsNamespace)
+	if err := validateMetricsNamespace(namespace); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	coordinateMode, err := parseCoordinateMode(os.Getenv("COORDINATE_MODE"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	cardinalPointLabel, err = parseCardinalPointLabel(os.Getenv("CARDINAL_POINT_LABEL"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	registerMetrics(namespace, coordinateMode)
+	registerInstanceMetrics(namespace)
+
+	shutdownTracing, err := broker.InitTracing(context.Background(), "coletor-metricas")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer shutdownTracing(context.Background())
+
+	pushJobs, err = parsePushJobs(os.Getenv("PUSH_JOBS"), getEnv("PUSH_JOB", defaultPushJob))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	pushURL = fmt.Sprintf("%s:%s", os.Getenv("PROMETHEUS_PUSHGATEWAY_HOST"), os.Getenv("PROMETHEUS_PUSHGATEWAY_PORT"))
+	log.Printf("metrics namespace: %s, push jobs: %v", namespace, pushJobs)
+
+	pushEnabled, err = parseBool("PUSH_ENABLED", true)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	metricsPort := os.Getenv("METRICS_PORT")
+	if !pushEnabled && metricsPort == "" {
+		log.Fatal("PUSH_ENABLED=false requires METRICS_PORT, or metrics would go nowhere")
+	}
+
+	pushExtraLabels, err = parseExtraLabels(os.Getenv("EXTRA_LABELS"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	pushClient.Timeout, err = parseDuration("PUSH_HTTP_TIMEOUT", defaultPushHTTPTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	pushUsername = os.Getenv("PUSHGATEWAY_USERNAME")
+	pushPassword = os.Getenv("PUSHGATEWAY_PASSWORD")
+	if pushPassword != "" && pushUsername == "" {
+		log.Fatal("PUSHGATEWAY_PASSWORD requires PUSHGATEWAY_USERNAME")
+	}
+
+	pushHeaders, err := parsePushHeaders(os.Getenv("PUSH_HEADERS"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(pushHeaders) > 0 {
+		pushClient.Transport = newHeaderTransport(pushHeaders)
+	}
+
+	instanceID = getEnv("INSTANCE_ID", defaultInstanceID())
+	log.Printf("instance: %s", instanceID)
+	instancePusher = newInstancePusher(pushURL, pushJobs[categoryCustom], instanceID, pushExtraLabels)
+
+	heartbeatInterval, err := parseDuration("HEARTBEAT_INTERVAL", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// WORKER_COUNT is the one bound on concurrent deliveries: the pool runs a
+	// fixed number of goroutines, Submit blocks while all of them are busy, and
+	// Close waits for them on shutdown, so a spike of deliveries queues up at
+	// the broker (up to PREFETCH_COUNT) rather than as goroutines.
+	workerCount, err = parseInt("WORKER_COUNT", defaultWorkerCount)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	queueDepthInterval, err := parseDuration("QUEUE_DEPTH_INTERVAL", defaultQueueDepthInterval)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	queues := broker.ParseQueues(os.Getenv("RABBITMQ_QUEUE"))
+	if len(queues) == 0 {
+		log.Fatal("RABBITMQ_QUEUE must list at least one queue")
+	}
+
+	if err := overrideErrorActions(os.Getenv("ERROR_ACTIONS")); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	shutdownGracePeriod, err := parseDuration("SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	shutdownTimeout, err := parseDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if warning := broker.ShutdownTimeoutWarning(shutdownTimeout, shutdownGracePeriod, finalInstancePushTimeout); warning != "" {
+		log.Print(warning)
+	}
+
+	window, err := parseDuration("PARSE_RATIO_WINDOW", defaultParseRatioWindow)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	parseRatioWindow = newRatioWindow(window, parseRatioWindowBuckets)
+	parseSuccessRatioMetric.Set(1)
+
+	exportGeohash, err = parseBool("EXPORT_GEOHASH", false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	geohashPrecision, err = parseInt("GEOHASH_PRECISION", defaultGeohashPrecision)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if geohashPrecision < 1 || geohashPrecision > 12 {
+		log.Fatalf("invalid GEOHASH_PRECISION \"%d\": must be between 1 and 12", geohashPrecision)
+	}
+
+	pushMaxRetries, err = parseInt("PUSH_MAX_RETRIES", defaultPushMaxRetries)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if pushMaxRetries < 0 {
+		log.Fatalf("invalid PUSH_MAX_RETRIES \"%d\": must not be negative", pushMaxRetries)
+	}
+
+	pushBackoff, err = parseDuration("PUSH_BACKOFF", defaultPushBackoff)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	maxFutureSkew, err = parseDuration("MAX_FUTURE_SKEW", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	maxMessageAge, err = parseDuration("MAX_MESSAGE_AGE", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	maxMessageBytes, err = parseInt("MAX_MESSAGE_BYTES", defaultMaxMessageBytes)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if maxMessageBytes <= 0 {
+		log.Fatalf("invalid MAX_MESSAGE_BYTES \"%d\": must be greater than zero", maxMessageBytes)
+	}
+
+	expectedContentType = os.Getenv("EXPECT_CONTENT_TYPE")
+
+	messageSchema, err = broker.SchemaFromEnv()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	temperatureUnit, err = parseTemperatureUnit(os.Getenv("TEMPERATURE_UNIT"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	machineName, err = parseMachineNameTransform(os.Getenv("MACHINE_NAME_TRIM_PREFIX"), os.Getenv("MACHINE_NAME_TRIM_SUFFIX"), os.Getenv("MACHINE_NAME_PATTERN"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	reconnectBackoff, err = broker.BackoffFromEnv(broker.Backoff{Initial: defaultReconnectBackoff, Max: defaultReconnectMaxBackoff})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	consumeOpts, err := broker.ConsumeOptionsFromEnv(broker.ConsumeOptions{Tag: broker.DefaultConsumerTag(consumerTagPrefix), Durable: false, Prefetch: defaultPrefetchCount, QueueArgs: deadLetterArgs, ManualAck: true})
 	if err != nil {
-		log.Fatalf("failed to open a channel: %v", err)
+		log.Fatal(err.Error())
+	}
+
+	deadLetterExchange = os.Getenv("DEAD_LETTER_EXCHANGE")
+	deadLetterQueue = os.Getenv("DEAD_LETTER_QUEUE")
+	log.Printf("queues %v: durable=%t auto_delete=%t exclusive=%t prefetch=%d", queues, consumeOpts.Durable, consumeOpts.AutoDelete, consumeOpts.Exclusive, consumeOpts.Prefetch)
+
+	brokerCfg, err := broker.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if broker.CheckConfigOnly() {
+		log.Println("configuration is valid")
+		return
+	}
+
+	if metricsPort != "" {
+		scrape = newScrapeCache()
+		serveMetrics(metricsPort, scrape)
+	}
+
+	log.Printf("connecting to %s", brokerCfg.RedactedURL())
+	conn, ch, err := broker.Connect(brokerCfg)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	broker.NotifyState(conn, ch, setConnectionState)
+
+	if err := registerDLQ(ch, queues); err != nil {
+		log.Fatal(err.Error())
 	}
 
-	msgsCh, err := registerConsumer(ch, queue)
+	msgsCh, consumerTags, err := broker.ConsumeAll(ch, queues, consumeOpts)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	log.Printf("consumer tags: %v", consumerTags)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	setReady(true)
+
+	// ctx is the parent of every per-message context. It is only cancelled once
+	// the shutdown grace period elapses, aborting whatever is still in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// heartbeat stays nil, and never fires, unless HEARTBEAT_INTERVAL is set.
+	var heartbeat <-chan time.Time
+	if heartbeatInterval > 0 {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+		log.Printf("pushing a heartbeat every %s", heartbeatInterval)
+	}
+	stopInstancePush := startInstancePush(heartbeat)
+
+	// Unless given its own, the management API shares the credentials and vhost
+	// of the AMQP connection.
+	if managementURL := os.Getenv("RABBITMQ_MANAGEMENT_URL"); managementURL != "" {
+		uri, err := amqp.ParseURI(brokerCfg.URL())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		management := newManagementClient(managementURL, getEnv("RABBITMQ_MANAGEMENT_USERNAME", uri.Username), getEnv("RABBITMQ_MANAGEMENT_PASSWORD", uri.Password), uri.Vhost)
+		go pollQueueDepth(ctx, management, queues, queueDepthInterval)
+		log.Printf("polling the depth of queues %v every %s", queues, queueDepthInterval)
+	}
+
+	pool, err := broker.NewPool(workerCount)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("workers: %d", workerCount)
+
+	handle := newHandler()
+	interrupted := false
+
 main_loop:
 	for {
 		select {
-		case msg := <-msgsCh:
-			log.Printf("[%s] received message: %s", time.Now(), string(msg.Body))
-			sendMetrics(msg.Body)
+		case msg, ok := <-msgsCh:
+			if !ok {
+				if interrupted {
+					break main_loop
+				}
+
+				setReady(false)
+				if !conn.IsClosed() {
+					log.Println("deliveries channel closed while the connection is up, reopening the channel...")
+					ch.Close()
+
+					newCh, newMsgsCh, newConsumerTags, err := reopenChannel(conn, queues, consumeOpts)
+					if err == nil {
+						ch, msgsCh, consumerTags = newCh, newMsgsCh, newConsumerTags
+						log.Printf("channel reopened, consumer tags: %v", consumerTags)
+						setReady(true)
+						continue
+					}
+					log.Printf("failed to reopen the channel: %v", err)
+				}
+
+				log.Println("deliveries channel closed, reconnecting...")
+				conn.Close()
+
+				newConn, newCh, newMsgsCh, newConsumerTags, err := reconnect(brokerCfg, queues, consumeOpts)
+				if err != nil {
+					log.Printf("failed to reconnect: %v", err)
+					break main_loop
+				}
+				conn, ch, msgsCh, consumerTags = newConn, newCh, newMsgsCh, newConsumerTags
+				log.Printf("reconnected, consumer tags: %v", consumerTags)
+				setReady(true)
+				continue
+			}
+
+			if err := pool.Submit(ctx, handle, msg); err != nil {
+				log.Printf("delivery %d left unhandled: %v", msg.DeliveryTag, err)
+			}
+
+		case <-reconnectRequests:
+			if interrupted {
+				continue
+			}
+
+			// Closing the connection closes msgsCh, whose case above reconnects.
+			log.Println("a delivery failed with the reconnect action, reconnecting...")
+			conn.Close()
 
 		case <-c:
 			fmt.Println("interrupting...")
-			ch.Close()
-			conn.Close()
+			interrupted = true
+			setReady(false)
+			if err := cancelConsumers(ch, consumerTags); err != nil {
+				log.Print(err.Error())
+				break main_loop
+			}
+			time.AfterFunc(shutdownGracePeriod, cancel)
+			broker.StartWatchdog(shutdownTimeout, operations)
+
+		case <-ctx.Done():
+			log.Printf("shutdown grace period of %s elapsed, closing with pending deliveries", shutdownGracePeriod)
 			break main_loop
 		}
 	}
+
+	pool.Close()
+	stopInstancePush()
+
+	ch.Close()
+	conn.Close()
+}
+
+// debugf logs only when DEBUG is enabled.
+func debugf(format string, args ...any) {
+	if debug {
+		log.Printf("[debug] "+format, args...)
+	}
 }
 
-func registerConsumer(ch *amqp.Channel, queue string) (<-chan amqp.Delivery, error) {
-	q, err := ch.QueueDeclare(
-		queue,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+func getEnv(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return def
+}
+
+func parseInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare a queue: %w", err)
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
 	}
 
-	msgs, err := ch.Consume(
-		q.Name,
-		"collector",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	return i, nil
+}
+
+func parseBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register a consumer: %w", err)
+		return false, fmt.Errorf("failed to parse %s: %w", name, err)
 	}
 
-	return msgs, nil
+	return b, nil
 }
 
-func sendMetrics(data []byte) {
-	var msg Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("failed to unmarshal message content: %v", err)
-		return
+// reconnect dials RabbitMQ again once the deliveries channel closed under us
+// and re-registers the consumers. It gives up on SIGINT/SIGTERM.
+func reconnect(cfg broker.Config, queues []string, opts broker.ConsumeOptions) (*amqp.Connection, *amqp.Channel, <-chan amqp.Delivery, []string, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, ch, err := broker.Reconnect(ctx, cfg, reconnectBackoff)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
+	amqpReconnectsMetric.Inc()
+	broker.NotifyState(conn, ch, setConnectionState)
 
-	pusher = pusher.Grouping("machine_name", msg.Metadata.Name)
+	if err := registerDLQ(ch, queues); err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
 
-	latitude_coordinates := msg.Metrics.Coordinates.Latitude
-	coordinates := strings.Split(latitude_coordinates, " ")
-	if len(coordinates) != 2 {
-		fmt.Println("invalid latitude coordinate")
-	} else {
-		latitude := coordinates[0]
-		coordinate, err := strconv.ParseFloat(latitude, 64)
-		if err != nil {
-			fmt.Println("invalid latitude coordinate")
+	msgsCh, tags, err := broker.ConsumeAll(ch, queues, opts)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return conn, ch, msgsCh, tags, nil
+}
+
+// reopenChannel opens a new channel on conn, which is still up, after the
+// broker closed the previous one (e.g. on a precondition failure), and starts
+// consuming from queues again without tearing down the connection.
+func reopenChannel(conn *amqp.Connection, queues []string, opts broker.ConsumeOptions) (*amqp.Channel, <-chan amqp.Delivery, []string, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	broker.NotifyState(conn, ch, setConnectionState)
+
+	if err := registerDLQ(ch, queues); err != nil {
+		ch.Close()
+		return nil, nil, nil, err
+	}
+
+	msgsCh, tags, err := broker.ConsumeAll(ch, queues, opts)
+	if err != nil {
+		ch.Close()
+		return nil, nil, nil, err
+	}
+
+	return ch, msgsCh, tags, nil
+}
+
+func cancelConsumers(ch channel, tags []string) error {
+	for _, tag := range tags {
+		if err := ch.Cancel(tag, false); err != nil {
+			return fmt.Errorf("failed to cancel consumer \"%s\": %w", tag, err)
 		}
-	
-		cardinalPoint := coordinates[1]
-		latitudeMetric.WithLabelValues(cardinalPoint).Set(coordinate)
-	}
-	
-	longitude_coordinates := msg.Metrics.Coordinates.Longitude
-	coordinates = strings.Split(longitude_coordinates, " ")
-	if len(coordinates) != 2 {
-		fmt.Println("invalid longitude coordinate")
-	} else {
-		longitude := coordinates[0]
-		coordinate, err := strconv.ParseFloat(longitude, 64)
-		if err != nil {
-			fmt.Println("invalid longitude coordinate")
+	}
+
+	return nil
+}
+
+func parseDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\": must be greater than zero", name, value)
+	}
+
+	return d, nil
+}
+
+// sendMetrics is the base handler of the delivery pipeline built by
+// newHandler. Failures are logged and counted here; the returned error only
+// feeds the middlewares (e.g. the span status).
+func sendMetrics(ctx context.Context, delivery amqp.Delivery) error {
+	if !isJSONArray(delivery.Body) {
+		return sendMessage(ctx, delivery)
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(delivery.Body, &elements); err != nil {
+		log.Printf("failed to unmarshal message batch (%s): %v", actionFor(err), err)
+		droppedMessagesMetric.WithLabelValues("decode_failed").Inc()
+		observeParse(false)
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("batch.size", len(elements)))
+
+	var errs []error
+	for _, element := range elements {
+		d := delivery
+		d.Body = element
+		if err := sendMessage(ctx, d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 && len(errs) < len(elements) {
+		log.Printf("dropped %d of the %d elements of the message batch, acking the others", len(errs), len(elements))
+		return fmt.Errorf("%w: %d of %d: %w", errPartialBatch, len(errs), len(elements), errors.Join(errs...))
+	}
+
+	return errors.Join(errs...)
+}
+
+// errPartialBatch marks a batch of which only some elements failed. The others
+// were already pushed, so it is acked whatever the failures: dead-lettering it
+// would push them again when the DLQ is replayed. The failed elements are
+// counted in dropped_messages_total by sendMessage.
+var errPartialBatch = errors.New("some elements of the message batch were dropped")
+
+// sendMessage decodes a single metrics report and pushes it. A failure only
+// drops this report, so the remaining elements of a batch are still pushed.
+func sendMessage(ctx context.Context, delivery amqp.Delivery) error {
+	msg, err := decodeMessage(delivery)
+	if err != nil {
+		log.Printf("failed to unmarshal message content (%s): %v", actionFor(err), err)
+		if errors.Is(err, errMisrouted) {
+			droppedMessagesMetric.WithLabelValues("misrouted").Inc()
+			return err
 		}
-	
-		cardinalPoint := coordinates[1]
-		longitudeMetric.WithLabelValues(cardinalPoint).Set(coordinate)
+		droppedMessagesMetric.WithLabelValues("decode_failed").Inc()
+		observeParse(false)
+		return err
 	}
 
-	temperatureMetric.WithLabelValues().Set(msg.Metrics.Temperature)
+	msg.Metadata.Name = machineName.apply(msg.Metadata.Name)
+
+	ts := messageTimestamp(delivery, msg)
+	if !ts.IsZero() {
+		clockSkewMetric.WithLabelValues(msg.Metadata.Name).Observe(now().Sub(ts).Seconds())
+	}
+
+	if maxFutureSkew > 0 && ts.After(now().Add(maxFutureSkew)) {
+		log.Printf("dropping message from \"%s\" timestamped %s, beyond the allowed future skew of %s", msg.Metadata.Name, ts, maxFutureSkew)
+		droppedMessagesMetric.WithLabelValues("future_timestamp").Inc()
+		return fmt.Errorf("message timestamped %s is beyond the allowed future skew", ts)
+	}
+
+	if maxMessageAge > 0 && !ts.IsZero() && ts.Before(now().Add(-maxMessageAge)) {
+		log.Printf("dropping message from \"%s\" timestamped %s, older than the allowed age of %s", msg.Metadata.Name, ts, maxMessageAge)
+		droppedMessagesMetric.WithLabelValues("stale_timestamp").Inc()
+		return fmt.Errorf("message timestamped %s is older than the allowed age", ts)
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("machine_name", msg.Metadata.Name))
+	parsed := true
+
+	grouping := map[string]string{"machine_name": msg.Metadata.Name, "instance": instanceID}
+
+	metricsMu.Lock()
+	resetMachineMetrics()
+	observeInterval(msg.Metadata.Name)
+
+	latitude, latitudeCardinal, latitudeErr := parseCoordinate(msg.Metrics.Coordinates.Latitude)
+	if errors.Is(latitudeErr, errMissingCoordinate) {
+		debugf("message from \"%s\" has no latitude, skipping it", msg.Metadata.Name)
+	} else if latitudeErr != nil {
+		log.Printf("invalid latitude coordinate: %v", latitudeErr)
+		droppedMessagesMetric.WithLabelValues("invalid_coordinate").Inc()
+		parsed = false
+	} else if latitudeErr = setCoordinate(latitudeMetric, latitude, latitudeCardinal, "N", "S"); latitudeErr != nil {
+		log.Printf("invalid latitude coordinate: %v", latitudeErr)
+		droppedMessagesMetric.WithLabelValues("invalid_cardinal_point").Inc()
+		parsed = false
+	}
+
+	longitude, longitudeCardinal, longitudeErr := parseCoordinate(msg.Metrics.Coordinates.Longitude)
+	if errors.Is(longitudeErr, errMissingCoordinate) {
+		debugf("message from \"%s\" has no longitude, skipping it", msg.Metadata.Name)
+	} else if longitudeErr != nil {
+		log.Printf("invalid longitude coordinate: %v", longitudeErr)
+		droppedMessagesMetric.WithLabelValues("invalid_coordinate").Inc()
+		parsed = false
+	} else if longitudeErr = setCoordinate(longitudeMetric, longitude, longitudeCardinal, "E", "W"); longitudeErr != nil {
+		log.Printf("invalid longitude coordinate: %v", longitudeErr)
+		droppedMessagesMetric.WithLabelValues("invalid_cardinal_point").Inc()
+		parsed = false
+	}
+
+	if exportGeohash && latitudeErr == nil && longitudeErr == nil {
+		geohash := encodeGeohash(signedCoordinate(latitude, latitudeCardinal), signedCoordinate(longitude, longitudeCardinal), geohashPrecision)
+		grouping["geohash"] = geohash
+	}
+
+	temperatureMetric.WithLabelValues().Set(celsius(msg.Metrics.Temperature))
 	cpuUsagePorcMetric.WithLabelValues().Set(msg.Metrics.CPUUsagePorc)
+	for core, usage := range msg.Metrics.CPUCores {
+		cpuCoreUsagePorcMetric.WithLabelValues(strconv.Itoa(core)).Set(usage)
+	}
 	memUsagePorcMetric.WithLabelValues().Set(msg.Metrics.MemUsagePorc)
 	memUsageBytesMetric.WithLabelValues().Set(float64(msg.Metrics.MemUsageBytes))
-
-	if err := pusher.Add(); err != nil {
+	observeParse(parsed)
+	snapshot, err := gatherAll()
+	metricsMu.Unlock()
+	if err != nil {
 		log.Printf("failed to push metrics: %v", err)
+		droppedMessagesMetric.WithLabelValues("push_failed").Inc()
+		return err
+	}
+	snapshot = machineSnapshot(snapshot, msg.Metadata.Name)
+
+	if scrape != nil {
+		scrape.store(grouping, snapshot)
+	}
+
+	if !pushEnabled {
+		return nil
 	}
+
+	if err := pushAll(ctx, newPushers(grouping, snapshot)); err != nil {
+		log.Printf("failed to push metrics (%s): %v", actionFor(err), err)
+		droppedMessagesMetric.WithLabelValues("push_failed").Inc()
+		return err
+	}
+
+	return nil
+}
+
+// observeInterval records the time since the previous message of machine. The
+// first message of a machine only starts the clock.
+func observeInterval(machine string) {
+	t := now()
+	if last, ok := lastMessageAt[machine]; ok {
+		messageIntervalMetric.WithLabelValues(machine).Observe(t.Sub(last).Seconds())
+	}
+	lastMessageAt[machine] = t
+}
+
+func observeParse(success bool) {
+	t := now()
+	parseRatioWindow.observe(t, success)
+	parseSuccessRatioMetric.Set(parseRatioWindow.ratio(t))
+}
+
+// messageTimestamp prefers the producer's metadata timestamp and falls back to
+// the AMQP timestamp property. A zero time means the message carries neither.
+func messageTimestamp(delivery amqp.Delivery, msg Message) time.Time {
+	if !msg.Metadata.Timestamp.IsZero() {
+		return msg.Metadata.Timestamp
+	}
+
+	return delivery.Timestamp
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const testNamespace = "test"
+
+// setupMetrics registers every metric under fresh registries, as main does at
+// startup, with pushes turned off so sendMessage only updates the registries.
+// The clock is frozen at start.
+func setupMetrics(t *testing.T, start time.Time) *time.Time {
+	t.Helper()
+
+	return setupMetricsMode(t, start, coordinateModeCardinal)
+}
+
+// setupMetricsMode is setupMetrics with the coordinates in mode.
+func setupMetricsMode(t *testing.T, start time.Time, mode string) *time.Time {
+	t.Helper()
+
+	registries = map[string]*prometheus.Registry{
+		categoryLocation: prometheus.NewRegistry(),
+		categorySystem:   prometheus.NewRegistry(),
+		categoryCustom:   prometheus.NewRegistry(),
+	}
+	instanceRegistry = prometheus.NewRegistry()
+	registerMetrics(testNamespace, mode)
+	registerInstanceMetrics(testNamespace)
+	instanceID = "replica-1"
+	select {
+	case <-instancePushRequests:
+	default:
+	}
+
+	parseRatioWindow = newRatioWindow(defaultParseRatioWindow, parseRatioWindowBuckets)
+	lastMessageAt = map[string]time.Time{}
+	maxMessageBytes = defaultMaxMessageBytes
+	maxFutureSkew, maxMessageAge = 0, 0
+	pushEnabled = false
+	scrape = nil
+
+	clock := start
+	now = func() time.Time { return clock }
+	t.Cleanup(func() {
+		now = time.Now
+		coordinateMode = coordinateModeCardinal
+		pushEnabled = true
+		scrape = nil
+	})
+
+	return &clock
+}
+
+// testMessage is the v1 body of a report from machine, timestamped at ts.
+func testMessage(t *testing.T, machine string, ts time.Time) amqp.Delivery {
+	t.Helper()
+
+	var msg Message
+	msg.Metadata.Name = machine
+	msg.Metadata.Timestamp = ts
+	msg.Metrics.Coordinates = Coordinates{Latitude: "23.5 S", Longitude: "46.6 W"}
+	msg.Metrics.Temperature = 300
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return amqp.Delivery{Body: body}
+}
+
+func send(t *testing.T, delivery amqp.Delivery) {
+	t.Helper()
+
+	if err := sendMetrics(context.Background(), delivery); err != nil {
+		t.Fatalf("sendMetrics: %v", err)
+	}
+}
+
+// machineFamilies gathers the metrics as the push of machine would carry them.
+func machineFamilies(t *testing.T, machine string) map[string][]*dto.MetricFamily {
+	t.Helper()
+
+	snapshot, err := gatherAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return machineSnapshot(snapshot, machine)
+}
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := gauge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+// scrapedValue is the gauge or counter of name of the instance group, as the
+// scrape cache serves it.
+func scrapedValue(t *testing.T, name string) float64 {
+	t.Helper()
+
+	families, err := scrape.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	family := findFamily(families, name)
+	if family == nil || len(family.Metric) != 1 {
+		t.Fatalf("%s is missing from the scrape: %v", name, family)
+	}
+
+	if counter := family.Metric[0].Counter; counter != nil {
+		return counter.GetValue()
+	}
+
+	return family.Metric[0].GetGauge().GetValue()
+}
+
+func findFamily(families []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, family := range families {
+		if family.GetName() == testNamespace+"_"+name {
+			return family
+		}
+	}
+
+	return nil
+}
+
+// histogramOf returns the single, unlabeled histogram of name in the custom
+// category of snapshot.
+func histogramOf(t *testing.T, snapshot map[string][]*dto.MetricFamily, name string) *dto.Histogram {
+	t.Helper()
+
+	family := findFamily(snapshot[categoryCustom], name)
+	if family == nil {
+		t.Fatalf("%s is missing", name)
+	}
+
+	if len(family.Metric) != 1 {
+		t.Fatalf("%s has %d series, want 1", name, len(family.Metric))
+	}
+
+	if labels := family.Metric[0].Label; len(labels) != 0 {
+		t.Fatalf("%s is labeled %v, want no labels", name, labels)
+	}
+
+	return family.Metric[0].Histogram
+}
+
+// TestSendMetricsCancelled checks a push in flight is abandoned once the
+// parent context is cancelled, as on shutdown after the grace period.
+func TestSendMetricsCancelled(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 300*time.Millisecond)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	began := time.Now()
+	err := sendMetrics(ctx, testMessage(t, "m1", start))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("sendMetrics = %v, want context.Canceled", err)
+	}
+
+	if elapsed := time.Since(began); elapsed >= 300*time.Millisecond {
+		t.Errorf("sendMetrics returned after %s, want it to give up on cancel", elapsed)
+	}
+
+	if got := len(gateway.pushed()); got > 1 {
+		t.Errorf("%d pushes were sent, want none after the cancel", got)
+	}
+}
+
+func TestMaxFutureSkew(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	maxFutureSkew = time.Minute
+	dropped := droppedMessagesMetric.WithLabelValues("future_timestamp")
+
+	if err := sendMetrics(context.Background(), testMessage(t, "m1", start.Add(2*time.Minute))); err == nil {
+		t.Error("a message two minutes in the future was accepted")
+	}
+	if got := counterValue(t, dropped); got != 1 {
+		t.Errorf("future_timestamp drops = %g, want 1", got)
+	}
+
+	send(t, testMessage(t, "m1", start.Add(30*time.Second)))
+	if got := counterValue(t, dropped); got != 1 {
+		t.Errorf("a message within the skew was dropped: future_timestamp drops = %g", got)
+	}
+}
+
+// TestSendMetricsMisrouted feeds the collector a sensor batch meant for the
+// controller and checks it is dropped as misrouted, for the broker to
+// dead-letter it, without pushing anything.
+func TestSendMetricsMisrouted(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{}
+
+	body := `{"sensors":[{"Id":"001","Location":"q1","AverageMoisture":10}]}`
+	err := sendMetrics(context.Background(), amqp.Delivery{Body: []byte(body)})
+	if !errors.Is(err, errMisrouted) {
+		t.Fatalf("sendMetrics = %v, want errMisrouted", err)
+	}
+
+	if action := actionFor(err); action != actionDeadLetter {
+		t.Errorf("a misrouted message is handled with %s, want %s", action, actionDeadLetter)
+	}
+
+	if got := counterValue(t, droppedMessagesMetric.WithLabelValues("misrouted")); got != 1 {
+		t.Errorf("misrouted drops = %g, want 1", got)
+	}
+	if got := counterValue(t, droppedMessagesMetric.WithLabelValues("decode_failed")); got != 0 {
+		t.Errorf("decode_failed drops = %g, want 0", got)
+	}
+
+	if paths := gateway.pushed(); len(paths) != 0 {
+		t.Errorf("a misrouted message was pushed: %v", paths)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"broker"
+)
+
+const (
+	defaultMetricsNamespace = "machines_monitoring"
+	defaultPushJob          = "machines_monitoring"
+)
+
+var (
+	// registries holds one registry per metric category, so each category can
+	// be pushed under its own job by the matching entry of pushJobs.
+	registries = map[string]*prometheus.Registry{
+		categoryLocation: prometheus.NewRegistry(),
+		categorySystem:   prometheus.NewRegistry(),
+		categoryCustom:   prometheus.NewRegistry(),
+	}
+
+	latitudeMetric           *prometheus.GaugeVec
+	longitudeMetric          *prometheus.GaugeVec
+	temperatureMetric        *prometheus.GaugeVec
+	cpuUsagePorcMetric       *prometheus.GaugeVec
+	cpuCoreUsagePorcMetric   *prometheus.GaugeVec
+	memUsagePorcMetric       *prometheus.GaugeVec
+	memUsageBytesMetric      *prometheus.GaugeVec
+	serviceReadyMetric       prometheus.Gauge
+	parseSuccessRatioMetric  prometheus.Gauge
+	inFlightMetric           prometheus.Gauge
+	processingDurationMetric prometheus.Histogram
+	clockSkewMetric          *prometheus.HistogramVec
+	messageIntervalMetric    *prometheus.HistogramVec
+	droppedMessagesMetric    *prometheus.CounterVec
+	bytesProcessedMetric     prometheus.Counter
+	amqpConnectedMetric      prometheus.Gauge
+	amqpChannelOpenMetric    prometheus.Gauge
+	rabbitmqConnectedMetric  prometheus.Gauge
+	amqpReconnectsMetric     prometheus.Counter
+	buildInfoMetric          *prometheus.GaugeVec
+	queueDepthMetric         *prometheus.GaugeVec
+	queueDepthSuccessMetric  *prometheus.GaugeVec
+
+	metricsNamespaceRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	labelNameRegexp        = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func validateMetricsNamespace(namespace string) error {
+	if !metricsNamespaceRegexp.MatchString(namespace) {
+		return fmt.Errorf("invalid METRICS_NAMESPACE \"%s\": must match %s", namespace, metricsNamespaceRegexp)
+	}
+
+	return nil
+}
+
+// registerMetrics builds every metric under namespace and registers them with
+// the registry of their category. It has to run once the configuration is
+// read, since the namespace is part of each metric name and the coordinate
+// mode decides the labels of the latitude/longitude gauges.
+func registerMetrics(namespace, mode string) {
+	coordinateMode = mode
+
+	latitudeMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "latitude",
+			Help:      "latitude coordinate of machine",
+			Namespace: namespace,
+		},
+		coordinateLabels(),
+	)
+
+	longitudeMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "longitude",
+			Help:      "longitude coordinate of machine",
+			Namespace: namespace,
+		},
+		coordinateLabels(),
+	)
+
+	temperatureMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "temperature",
+			Help:      "temperature of machine",
+			Namespace: namespace,
+		},
+		[]string{},
+	)
+
+	cpuUsagePorcMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "cpu_usage_porc",
+			Help:      "cpu usage of machine in porcentage (0.0 - 1.0)",
+			Namespace: namespace,
+		},
+		[]string{},
+	)
+
+	cpuCoreUsagePorcMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "cpu_core_usage_porc",
+			Help:      "cpu usage of each machine core in porcentage (0.0 - 1.0)",
+			Namespace: namespace,
+		},
+		[]string{"core"},
+	)
+
+	memUsagePorcMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "mem_usage_porc",
+			Help:      "memory usage of machine in porcentage (0.0 - 1.0)",
+			Namespace: namespace,
+		},
+		[]string{},
+	)
+
+	memUsageBytesMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "mem_usage_bytes",
+			Help:      "memory usage of machine in bytes",
+			Namespace: namespace,
+		},
+		[]string{},
+	)
+
+	serviceReadyMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "service_ready",
+			Help:      "whether the collector is ready to process messages (1) or not (0)",
+			Namespace: namespace,
+		},
+	)
+
+	parseSuccessRatioMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "parse_success_ratio",
+			Help:      "ratio of messages parsed without errors over the rolling window (0.0 - 1.0)",
+			Namespace: namespace,
+		},
+	)
+
+	inFlightMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "messages_in_flight",
+			Help:      "number of received messages not yet fully processed",
+			Namespace: namespace,
+		},
+	)
+
+	processingDurationMetric = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:      "message_processing_duration_seconds",
+			Help:      "time spent processing a message, including the push to the Pushgateway",
+			Namespace: namespace,
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+
+	// clockSkewMetric keeps one histogram per machine. machineSnapshot turns
+	// its machine_name label into the grouping key of the push, so each group
+	// only carries the skew of its own machine. Negative values mean the
+	// producer clock is ahead.
+	clockSkewMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:      "producer_clock_skew_seconds",
+			Help:      "local receive time minus the message timestamp",
+			Namespace: namespace,
+			Buckets:   []float64{-60, -10, -1, -0.1, 0, 0.1, 1, 10, 60, 300},
+		},
+		[]string{"machine_name"},
+	)
+
+	// messageIntervalMetric keeps one histogram per machine too, pushed the
+	// same way as clockSkewMetric.
+	messageIntervalMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:      "message_interval_seconds",
+			Help:      "time between consecutive messages of the same machine",
+			Namespace: namespace,
+			Buckets:   []float64{1, 5, 10, 15, 30, 60, 120, 300, 600},
+		},
+		[]string{"machine_name"},
+	)
+
+	droppedMessagesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "messages_dropped_total",
+			Help:      "number of messages (or invalid fields of a message) dropped instead of being pushed",
+			Namespace: namespace,
+		},
+		[]string{"reason"},
+	)
+
+	bytesProcessedMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "bytes_processed_total",
+			Help:      "total size of the delivery bodies handled, as received (before decompression)",
+			Namespace: namespace,
+		},
+	)
+
+	amqpConnectedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "amqp_connected",
+			Help:      "whether the connection to RabbitMQ is open (1) or not (0)",
+			Namespace: namespace,
+		},
+	)
+
+	amqpChannelOpenMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "amqp_channel_open",
+			Help:      "whether the AMQP channel is open (1) or not (0)",
+			Namespace: namespace,
+		},
+	)
+
+	// rabbitmqConnectedMetric carries no namespace so a single alert rule covers
+	// every service.
+	rabbitmqConnectedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rabbitmq_connected",
+			Help: "whether the service holds a live connection to RabbitMQ (1) or not (0)",
+		},
+	)
+
+	amqpReconnectsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "amqp_reconnects_total",
+			Help:      "number of times the collector reconnected to RabbitMQ",
+			Namespace: namespace,
+		},
+	)
+
+	buildInfoMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "build_info",
+			Help:      "always 1, labeled with the version, commit and Go version the collector was built with",
+			Namespace: namespace,
+		},
+		[]string{"version", "commit", "go_version"},
+	)
+
+	queueDepthMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "queue_depth",
+			Help:      "number of messages in a consumed queue, as reported by the RabbitMQ management API",
+			Namespace: namespace,
+		},
+		[]string{"queue"},
+	)
+
+	queueDepthSuccessMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "queue_depth_scrape_success",
+			Help:      "1 if the last poll of the depth of a consumed queue succeeded, 0 otherwise",
+			Namespace: namespace,
+		},
+		[]string{"queue"},
+	)
+
+	buildInfoMetric.WithLabelValues(broker.Version, broker.Commit, broker.GoVersion()).Set(1)
+
+	// The metrics describing the collector rather than a machine are pushed
+	// with the instance metrics, once per collector: copied into every machine
+	// group, a sum() over the groups would count them once per machine.
+	instanceRegistry.MustRegister(serviceReadyMetric)
+	instanceRegistry.MustRegister(parseSuccessRatioMetric)
+	instanceRegistry.MustRegister(inFlightMetric)
+	instanceRegistry.MustRegister(processingDurationMetric)
+	instanceRegistry.MustRegister(droppedMessagesMetric)
+	instanceRegistry.MustRegister(bytesProcessedMetric)
+	instanceRegistry.MustRegister(amqpConnectedMetric)
+	instanceRegistry.MustRegister(amqpChannelOpenMetric)
+	instanceRegistry.MustRegister(rabbitmqConnectedMetric)
+	instanceRegistry.MustRegister(amqpReconnectsMetric)
+	instanceRegistry.MustRegister(buildInfoMetric)
+	instanceRegistry.MustRegister(queueDepthMetric)
+	instanceRegistry.MustRegister(queueDepthSuccessMetric)
+
+	registries[categoryLocation].MustRegister(latitudeMetric)
+	registries[categoryLocation].MustRegister(longitudeMetric)
+	registries[categorySystem].MustRegister(temperatureMetric)
+	registries[categorySystem].MustRegister(cpuUsagePorcMetric)
+	registries[categorySystem].MustRegister(cpuCoreUsagePorcMetric)
+	registries[categorySystem].MustRegister(memUsagePorcMetric)
+	registries[categorySystem].MustRegister(memUsageBytesMetric)
+	registries[categoryCustom].MustRegister(clockSkewMetric)
+	registries[categoryCustom].MustRegister(messageIntervalMetric)
+}
+
+// resetMachineMetrics clears the gauges describing a single machine, the ones of
+// the location and system categories. It is called with metricsMu held before
+// each message sets them, so a field missing from a message is left out of its
+// push instead of carrying the value of the previous machine.
+func resetMachineMetrics() {
+	latitudeMetric.Reset()
+	longitudeMetric.Reset()
+	temperatureMetric.Reset()
+	cpuUsagePorcMetric.Reset()
+	cpuCoreUsagePorcMetric.Reset()
+	memUsagePorcMetric.Reset()
+	memUsageBytesMetric.Reset()
+}
+
+func setConnectionState(state broker.State) {
+	amqpConnectedMetric.Set(boolToFloat(state.Connected))
+	rabbitmqConnectedMetric.Set(boolToFloat(state.Connected))
+	amqpChannelOpenMetric.Set(boolToFloat(state.ChannelOpen))
+	requestInstancePush()
+}
+
+func boolToFloat(v bool) float64 {
+	if v {
+		return 1
+	}
+
+	return 0
+}
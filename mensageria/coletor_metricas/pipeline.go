@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// newHandler wraps sendMetrics with the middlewares every delivery goes
+// through, outermost first.
+func newHandler() broker.Handler {
+	return broker.Chain(
+		sendMetrics,
+		acknowledge,
+		pushInstanceMetrics,
+		trackInFlight,
+		countBytes,
+		timeProcessing,
+		broker.Trace(tracer, "sendMetrics"),
+		broker.Track(operations),
+		limitSize,
+		checkContentType,
+		decompress,
+		logDelivery,
+		validateSchema,
+	)
+}
+
+// validateSchema drops, or dead-letters, deliveries whose body does not match
+// the MESSAGE_SCHEMA_PATH schema. Without a schema every delivery goes through.
+func validateSchema(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if messageSchema == nil {
+			return next(ctx, delivery)
+		}
+
+		if err := messageSchema.Validate(delivery.Body); err != nil {
+			log.Printf("dropping message (%s): %v", actionFor(err), err)
+			droppedMessagesMetric.WithLabelValues("schema").Inc()
+			return err
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+func logDelivery(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		log.Printf("[%s] received message: %s", time.Now(), string(delivery.Body))
+		return next(ctx, delivery)
+	}
+}
+
+func countBytes(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		bytesProcessedMetric.Add(float64(len(delivery.Body)))
+		return next(ctx, delivery)
+	}
+}
+
+// pushInstanceMetrics requests a push of the instance metrics once a delivery
+// is done with, so the counters it updated reach the Pushgateway without
+// waiting for the heartbeat.
+func pushInstanceMetrics(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		defer requestInstancePush()
+		return next(ctx, delivery)
+	}
+}
+
+func trackInFlight(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		inFlightMetric.Inc()
+		defer inFlightMetric.Dec()
+
+		return next(ctx, delivery)
+	}
+}
+
+func timeProcessing(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		timer := prometheus.NewTimer(processingDurationMetric)
+		defer timer.ObserveDuration()
+
+		return next(ctx, delivery)
+	}
+}
+
+// errUnexpectedContentType is returned for deliveries whose content type is
+// not EXPECT_CONTENT_TYPE.
+var errUnexpectedContentType = errors.New("unexpected content type")
+
+// checkContentType drops deliveries whose content type does not match
+// EXPECT_CONTENT_TYPE. It does nothing when EXPECT_CONTENT_TYPE is unset.
+func checkContentType(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if expectedContentType != "" && !broker.ContentTypeMatches(expectedContentType, delivery.ContentType) {
+			err := fmt.Errorf("%w \"%s\", expected \"%s\"", errUnexpectedContentType, delivery.ContentType, expectedContentType)
+			log.Printf("dropping message (%s): %v", actionFor(err), err)
+			droppedMessagesMetric.WithLabelValues("content_type").Inc()
+			return err
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+// decompress gunzips the body of deliveries sent with a gzip content
+// encoding, dropping the ones that cannot be decompressed.
+func decompress(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		delivery, err := broker.Decompress(delivery, maxMessageBytes)
+		if err != nil {
+			log.Printf("dropping message (%s): %v", actionFor(err), err)
+			droppedMessagesMetric.WithLabelValues("decompress_failed").Inc()
+			return err
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+// limitSize drops deliveries larger than MAX_MESSAGE_BYTES before anything
+// tries to decode them.
+func limitSize(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if len(delivery.Body) > maxMessageBytes {
+			log.Printf("dropping message of %d bytes, larger than MAX_MESSAGE_BYTES (%d)", len(delivery.Body), maxMessageBytes)
+			droppedMessagesMetric.WithLabelValues("oversized").Inc()
+			return fmt.Errorf("message of %d bytes exceeds MAX_MESSAGE_BYTES", len(delivery.Body))
+		}
+
+		return next(ctx, delivery)
+	}
+}
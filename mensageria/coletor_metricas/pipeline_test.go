@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTrackInFlight(t *testing.T) {
+	setupMetrics(t, time.Now())
+
+	var during float64
+	handle := trackInFlight(func(ctx context.Context, delivery amqp.Delivery) error {
+		during = gaugeValue(t, inFlightMetric)
+		return nil
+	})
+
+	if err := handle(context.Background(), amqp.Delivery{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if during != 1 {
+		t.Errorf("messages_in_flight = %g while handling a delivery, want 1", during)
+	}
+	if got := gaugeValue(t, inFlightMetric); got != 0 {
+		t.Errorf("messages_in_flight = %g once the delivery is handled, want 0", got)
+	}
+}
+
+// TestCheckContentType checks a delivery of the expected content type reaches
+// the handler, one of another content type is dropped and counted, and every
+// delivery goes through while EXPECT_CONTENT_TYPE is unset.
+func TestCheckContentType(t *testing.T) {
+	setupMetrics(t, time.Now())
+	t.Cleanup(func() { expectedContentType = "" })
+	dropped := droppedMessagesMetric.WithLabelValues("content_type")
+	before := counterValue(t, dropped)
+
+	var handled int
+	handle := checkContentType(func(ctx context.Context, delivery amqp.Delivery) error {
+		handled++
+		return nil
+	})
+
+	tests := []struct {
+		expected, contentType string
+		pass                  bool
+	}{
+		{"", "text/plain", true},
+		{"", "", true},
+		{"application/json", "application/json", true},
+		{"application/json", "application/json; charset=utf-8", true},
+		{"application/json", "text/plain", false},
+		{"application/json", "", false},
+	}
+
+	for _, tt := range tests {
+		expectedContentType = tt.expected
+		handled = 0
+		err := handle(context.Background(), amqp.Delivery{ContentType: tt.contentType})
+
+		if pass := err == nil && handled == 1; pass != tt.pass {
+			t.Errorf("EXPECT_CONTENT_TYPE %q, content type %q: handled %d times, err %v, want passed %t", tt.expected, tt.contentType, handled, err, tt.pass)
+		}
+	}
+
+	if got := counterValue(t, dropped) - before; got != 2 {
+		t.Errorf("content_type drops went up by %g, want 2", got)
+	}
+}
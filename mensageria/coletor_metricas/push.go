@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultPushMaxRetries  = 3
+	defaultPushBackoff     = 500 * time.Millisecond
+	defaultPushHTTPTimeout = 10 * time.Second
+
+	categoryLocation = "location"
+	categorySystem   = "system"
+	categoryCustom   = "custom"
+)
+
+// metricCategories is the order the categories are pushed in.
+var metricCategories = []string{categoryLocation, categorySystem, categoryCustom}
+
+var (
+	pushMaxRetries = defaultPushMaxRetries
+	pushBackoff    = defaultPushBackoff
+
+	// pushURL, pushJobs and pushExtraLabels are only set at startup, so every
+	// message can build its own pushers from them.
+	pushURL         string
+	pushJobs        map[string]string
+	pushExtraLabels map[string]string
+
+	// pushClient bounds each push by PUSH_HTTP_TIMEOUT, so a dead Pushgateway
+	// fails the push instead of holding a worker forever.
+	pushClient = &http.Client{Timeout: defaultPushHTTPTimeout}
+
+	// pushUsername and pushPassword are PUSHGATEWAY_USERNAME and
+	// PUSHGATEWAY_PASSWORD, sent as basic auth when the username is set.
+	pushUsername string
+	pushPassword string
+
+	// instanceID is INSTANCE_ID, the collector hostname by default. It is the
+	// "instance" of every push grouping and scraped series, so replicas do not
+	// overwrite each other.
+	instanceID string
+
+	// metricsMu serializes the messages from setting their gauges to gathering
+	// them, so concurrent messages cannot push each other's values.
+	metricsMu sync.Mutex
+)
+
+// parsePushJobs maps each metric category to its Pushgateway job. The spec is
+// a comma separated list of category=job pairs (e.g. "location=geo"), and
+// categories left out are pushed under defaultJob.
+//
+// Every category is pushed with the same grouping key (machine_name and, when
+// enabled, geohash), so a series is addressed on the Pushgateway by its job
+// plus that grouping key. Categories sharing a job also share the group, so
+// they are pushed together in one request rather than racing each other. The
+// instance metrics go under the job of the custom category, grouped by
+// instance alone.
+func parsePushJobs(spec, defaultJob string) (map[string]string, error) {
+	jobs := make(map[string]string, len(metricCategories))
+	for _, category := range metricCategories {
+		jobs[category] = defaultJob
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		category, job, ok := strings.Cut(entry, "=")
+		category, job = strings.TrimSpace(category), strings.TrimSpace(job)
+		if !ok || job == "" {
+			return nil, fmt.Errorf("invalid push job \"%s\": expected category=job", entry)
+		}
+
+		if _, ok := jobs[category]; !ok {
+			return nil, fmt.Errorf("invalid push job \"%s\": unknown category \"%s\"", entry, category)
+		}
+
+		jobs[category] = job
+	}
+
+	return jobs, nil
+}
+
+// gatherAll snapshots the registry of every category. It must be called with
+// metricsMu held, right after a message has set its gauges.
+func gatherAll() (map[string][]*dto.MetricFamily, error) {
+	snapshot := make(map[string][]*dto.MetricFamily, len(registries))
+	for category, registry := range registries {
+		families, err := registry.Gather()
+		if err != nil {
+			return nil, fmt.Errorf("failed to gather %s metrics: %w", category, err)
+		}
+		snapshot[category] = families
+	}
+
+	return snapshot, nil
+}
+
+// machineSnapshot keeps, of the series labeled by machine_name, only those of
+// machine and drops the label from them: the push and the scrape cache add it
+// back from the grouping, and the Pushgateway rejects a metric carrying a label
+// of the grouping key.
+func machineSnapshot(snapshot map[string][]*dto.MetricFamily, machine string) map[string][]*dto.MetricFamily {
+	filtered := make(map[string][]*dto.MetricFamily, len(snapshot))
+	for category, families := range snapshot {
+		for _, family := range families {
+			if !slices.ContainsFunc(family.Metric, hasMachineLabel) {
+				filtered[category] = append(filtered[category], family)
+				continue
+			}
+
+			var metrics []*dto.Metric
+			for _, metric := range family.Metric {
+				i := slices.IndexFunc(metric.Label, isMachineLabel)
+				if i < 0 || metric.Label[i].GetValue() != machine {
+					continue
+				}
+
+				metrics = append(metrics, &dto.Metric{
+					Label:       slices.Delete(slices.Clone(metric.Label), i, i+1),
+					Gauge:       metric.Gauge,
+					Counter:     metric.Counter,
+					Summary:     metric.Summary,
+					Untyped:     metric.Untyped,
+					Histogram:   metric.Histogram,
+					TimestampMs: metric.TimestampMs,
+				})
+			}
+
+			if len(metrics) > 0 {
+				filtered[category] = append(filtered[category], &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Metric: metrics})
+			}
+		}
+	}
+
+	return filtered
+}
+
+func hasMachineLabel(metric *dto.Metric) bool {
+	return slices.ContainsFunc(metric.Label, isMachineLabel)
+}
+
+func isMachineLabel(label *dto.LabelPair) bool {
+	return label.GetName() == "machine_name"
+}
+
+// jobPusher pushes the categories sharing a Pushgateway job.
+type jobPusher struct {
+	job        string
+	categories []string
+	pusher     *push.Pusher
+}
+
+// newPushers builds the pushers of a single message, one per job of
+// PUSH_JOBS, pushing the snapshot taken by gatherAll of every category of that
+// job under the grouping of the message plus EXTRA_LABELS. With the default
+// PUSH_JOBS every category shares a job, so a message is a single push.
+// Nothing is shared between messages, so the grouping of one machine cannot
+// leak into the push of another.
+func newPushers(grouping map[string]string, snapshot map[string][]*dto.MetricFamily) []jobPusher {
+	var pushers []jobPusher
+	byJob := make(map[string]int, len(pushJobs))
+	for _, category := range metricCategories {
+		job := pushJobs[category]
+		i, ok := byJob[job]
+		if !ok {
+			p := newPusher(pushURL, job)
+			for name, value := range pushExtraLabels {
+				p = p.Grouping(name, value)
+			}
+			for name, value := range grouping {
+				p = p.Grouping(name, value)
+			}
+
+			i = len(pushers)
+			byJob[job] = i
+			pushers = append(pushers, jobPusher{job: job, pusher: p})
+		}
+
+		families := snapshot[category]
+		pushers[i].categories = append(pushers[i].categories, category)
+		pushers[i].pusher = pushers[i].pusher.Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, nil
+		}))
+	}
+
+	return pushers
+}
+
+// reservedGroupingLabels are set per message or by the metrics themselves, so
+// EXTRA_LABELS may not use them.
+var reservedGroupingLabels = []string{"job", "instance", "machine_name", "geohash", "core", "cardinal_point", "version", "commit", "go_version", "queue"}
+
+// parseExtraLabels reads EXTRA_LABELS, a comma separated list of name=value
+// pairs added as grouping keys to every push. Names must be valid Prometheus
+// label names.
+func parseExtraLabels(spec string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid extra label \"%s\": expected name=value", entry)
+		}
+
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid extra label \"%s\": \"%s\" is not a valid label name", entry, name)
+		}
+
+		if slices.Contains(reservedGroupingLabels, name) || name == cardinalPointLabel {
+			return nil, fmt.Errorf("invalid extra label \"%s\": \"%s\" is reserved", entry, name)
+		}
+
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("invalid extra label \"%s\": duplicate label \"%s\"", entry, name)
+		}
+
+		labels[name] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
+}
+
+// headerTransport adds PUSH_HEADERS to every request, e.g. the X-Scope-OrgID
+// tenant of a multi-tenant backend behind the Pushgateway.
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+func newHeaderTransport(headers http.Header) http.RoundTripper {
+	return headerTransport{headers: headers, next: http.DefaultTransport}
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// parsePushHeaders parses PUSH_HEADERS, a comma-separated list of Name=value
+// pairs such as "X-Scope-OrgID=tenant-1".
+func parsePushHeaders(spec string) (http.Header, error) {
+	headers := http.Header{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid push header \"%s\": expected Name=value", entry)
+		}
+
+		headers.Add(name, strings.TrimSpace(value))
+	}
+
+	return headers, nil
+}
+
+// newPusher is push.New with the HTTP client and credentials every push to the
+// Pushgateway shares.
+func newPusher(url, job string) *push.Pusher {
+	p := push.New(url, job).Client(pushClient)
+	if pushUsername != "" {
+		p = p.BasicAuth(pushUsername, pushPassword)
+	}
+
+	return p
+}
+
+// pushAll pushes every job, carrying on past failures so one unreachable job
+// does not hold back the others.
+func pushAll(ctx context.Context, pushers []jobPusher) error {
+	var errs []error
+	for _, p := range pushers {
+		categories := strings.Join(p.categories, ", ")
+		done := operations.Start(fmt.Sprintf("push of %s metrics", categories))
+		if err := pushWithRetry(ctx, p.pusher); err != nil {
+			errs = append(errs, fmt.Errorf("failed to push %s metrics to job \"%s\": %w", categories, p.job, err))
+		}
+		done()
+	}
+
+	return errors.Join(errs...)
+}
+
+// pushWithRetry adds the gathered metrics to the Pushgateway, retrying the
+// failures classified as retryable with an exponential backoff. It gives up as
+// soon as ctx is done so a shutdown is never held by a dead Pushgateway.
+func pushWithRetry(ctx context.Context, p *push.Pusher) error {
+	backoff := pushBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.AddContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= pushMaxRetries || actionFor(err) != actionRetry {
+			return err
+		}
+
+		log.Printf("failed to push metrics (attempt %d), retrying in %s: %v", attempt+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestClockSkewPerMachine feeds messages with a known skew and checks each
+// machine group only carries the skew of its own machine.
+func TestClockSkewPerMachine(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+
+	send(t, testMessage(t, "m1", start.Add(-2*time.Second)))
+	send(t, testMessage(t, "m1", start.Add(-4*time.Second)))
+	send(t, testMessage(t, "m2", start.Add(5*time.Second)))
+
+	m1 := histogramOf(t, machineFamilies(t, "m1"), "producer_clock_skew_seconds")
+	if m1.GetSampleCount() != 2 || m1.GetSampleSum() != 6 {
+		t.Errorf("m1 skew: count %d, sum %g, want 2 and 6", m1.GetSampleCount(), m1.GetSampleSum())
+	}
+
+	m2 := histogramOf(t, machineFamilies(t, "m2"), "producer_clock_skew_seconds")
+	if m2.GetSampleCount() != 1 || m2.GetSampleSum() != -5 {
+		t.Errorf("m2 skew: count %d, sum %g, want 1 and -5", m2.GetSampleCount(), m2.GetSampleSum())
+	}
+}
+
+func TestMachineSnapshotDropsOtherMachines(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+
+	send(t, testMessage(t, "m1", start))
+
+	if family := findFamily(machineFamilies(t, "m3")[categoryCustom], "producer_clock_skew_seconds"); family != nil {
+		t.Errorf("m3 group carries the skew of another machine: %v", family)
+	}
+
+	if family := findFamily(machineFamilies(t, "m3")[categorySystem], "temperature"); family == nil {
+		t.Error("unlabeled families were dropped")
+	}
+}
+
+// TestMessageIntervalPerMachine feeds timed messages and checks the intervals
+// recorded for each machine. The first message of a machine records nothing.
+func TestMessageIntervalPerMachine(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setupMetrics(t, start)
+
+	send(t, testMessage(t, "m1", time.Time{}))
+	if family := findFamily(machineFamilies(t, "m1")[categoryCustom], "message_interval_seconds"); family != nil {
+		t.Errorf("the first message recorded an interval: %v", family)
+	}
+
+	*clock = start.Add(10 * time.Second)
+	send(t, testMessage(t, "m1", time.Time{}))
+	send(t, testMessage(t, "m2", time.Time{}))
+
+	*clock = start.Add(40 * time.Second)
+	send(t, testMessage(t, "m1", time.Time{}))
+	send(t, testMessage(t, "m2", time.Time{}))
+
+	m1 := histogramOf(t, machineFamilies(t, "m1"), "message_interval_seconds")
+	if m1.GetSampleCount() != 2 || m1.GetSampleSum() != 40 {
+		t.Errorf("m1 intervals: count %d, sum %g, want 2 and 40", m1.GetSampleCount(), m1.GetSampleSum())
+	}
+
+	m2 := histogramOf(t, machineFamilies(t, "m2"), "message_interval_seconds")
+	if m2.GetSampleCount() != 1 || m2.GetSampleSum() != 30 {
+		t.Errorf("m2 intervals: count %d, sum %g, want 1 and 30", m2.GetSampleCount(), m2.GetSampleSum())
+	}
+}
+
+func TestParsePushJobs(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}, false},
+		{"location=geo", map[string]string{categoryLocation: "geo", categorySystem: "job", categoryCustom: "job"}, false},
+		{" location = geo , custom=app,", map[string]string{categoryLocation: "geo", categorySystem: "job", categoryCustom: "app"}, false},
+		{"location", nil, true},
+		{"location=", nil, true},
+		{"network=net", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePushJobs(tt.spec, "job")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePushJobs(%q) error = %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("parsePushJobs(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// TestPushJobsPerCategory sends a message with a job configured per category
+// and checks each category is pushed under its own job, with the same grouping
+// key.
+func TestPushJobsPerCategory(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "geo", categorySystem: "sys", categoryCustom: "app"}
+	pushExtraLabels = map[string]string{}
+
+	send(t, testMessage(t, "m1", start))
+
+	for _, job := range []string{"geo", "sys", "app"} {
+		// The grouping labels are pushed in no particular order.
+		prefix := "/metrics/job/" + job + "/"
+		if !slices.ContainsFunc(gateway.pushed(), func(path string) bool {
+			return strings.Contains(path, prefix) && strings.Contains(path, "/machine_name/m1")
+		}) {
+			t.Errorf("m1 was not pushed under job %s: %v", job, gateway.pushed())
+		}
+	}
+
+	if slices.ContainsFunc(gateway.pushed(), func(path string) bool {
+		return strings.Contains(path, "/metrics/job/job/")
+	}) {
+		t.Errorf("a category was pushed under the default job: %v", gateway.pushed())
+	}
+}
+
+// TestPushJobsShared checks the categories sharing a job are pushed together,
+// in a single request carrying the metrics of all of them, and that only the
+// category with a job of its own is pushed apart.
+func TestPushJobsShared(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushExtraLabels = map[string]string{}
+
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	send(t, testMessage(t, "m1", start))
+	if paths := gateway.pushed(); len(paths) != 1 || !strings.Contains(paths[0], "/metrics/job/job/") {
+		t.Errorf("pushes with a single job = %v, want one", paths)
+	}
+
+	pushJobs = map[string]string{categoryLocation: "geo", categorySystem: "job", categoryCustom: "job"}
+	send(t, testMessage(t, "m1", start))
+	if paths := gateway.pushed()[1:]; len(paths) != 2 {
+		t.Errorf("pushes with two jobs = %v, want two", paths)
+	}
+
+	pushers := newPushers(map[string]string{"machine_name": "m1"}, machineFamilies(t, "m1"))
+	if len(pushers) != 2 || pushers[0].job != "geo" || pushers[1].job != "job" {
+		t.Fatalf("pushers = %+v, want geo then job", pushers)
+	}
+	if got := fmt.Sprint(pushers[1].categories); got != "[system custom]" {
+		t.Errorf("categories pushed under job = %s, want [system custom]", got)
+	}
+}
+
+// TestSendMetricsConcurrent pushes the messages of several machines from many
+// goroutines at once, as the worker pool does, and checks every push carries
+// the grouping of its own machine only. Run with -race it also covers the
+// pushers being built per message.
+func TestSendMetricsConcurrent(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	pushEnabled = true
+	gateway := newTestPushgateway(t, 0)
+	pushURL = gateway.URL
+	pushJobs = map[string]string{categoryLocation: "job", categorySystem: "job", categoryCustom: "job"}
+	pushExtraLabels = map[string]string{"env": "test"}
+
+	const machines, messages = 8, 10
+
+	var wg sync.WaitGroup
+	for m := range machines {
+		for range messages {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := sendMetrics(context.Background(), testMessage(t, fmt.Sprintf("m%d", m), start)); err != nil {
+					t.Errorf("sendMetrics: %v", err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	paths := gateway.pushed()
+	if want := machines * messages; len(paths) != want {
+		t.Errorf("got %d pushes, want one per message: %d", len(paths), want)
+	}
+
+	for _, path := range paths {
+		if n := strings.Count(path, "/machine_name/"); n != 1 {
+			t.Errorf("%s carries %d machine names, want 1", path, n)
+		}
+		if !strings.Contains(path, "/env/test") || !strings.Contains(path, "/instance/replica-1") {
+			t.Errorf("%s is missing the shared grouping labels", path)
+		}
+	}
+}
+
+// TestMachinesDoNotInheritGauges interleaves two machines, the second one
+// without coordinates and with fewer cores, and checks its push carries none
+// of the values the first one set.
+func TestMachinesDoNotInheritGauges(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+
+	full := testMessage(t, "m1", start)
+	var msg Message
+	err := json.Unmarshal(full.Body, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Metrics.CPUCores = []float64{10, 20}
+	if full.Body, err = json.Marshal(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var partial Message
+	partial.Metadata.Name = "m2"
+	partial.Metrics.Temperature = 280
+	partial.Metrics.CPUCores = []float64{30}
+	body, err := json.Marshal(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, delivery := range []amqp.Delivery{full, {Body: body}} {
+		send(t, delivery)
+	}
+
+	families := machineFamilies(t, "m2")
+	for _, name := range []string{"latitude", "longitude"} {
+		if family := findFamily(families[categoryLocation], name); family != nil && len(family.Metric) > 0 {
+			t.Errorf("m2 inherited the %s of m1: %v", name, family.Metric)
+		}
+	}
+
+	cores := findFamily(families[categorySystem], "cpu_core_usage_porc")
+	if cores == nil || len(cores.Metric) != 1 || cores.Metric[0].GetGauge().GetValue() != 30 {
+		t.Errorf("m2 cores = %v, want its single core only", cores)
+	}
+
+	if got := gaugeValue(t, temperatureMetric.WithLabelValues()); got != 280 {
+		t.Errorf("temperature = %g, want the one of m2", got)
+	}
+
+	// m1 gets its own values back with its next message.
+	send(t, full)
+	if family := findFamily(machineFamilies(t, "m1")[categoryLocation], "latitude"); family == nil || len(family.Metric) != 1 {
+		t.Errorf("m1 lost its latitude: %v", family)
+	}
+}
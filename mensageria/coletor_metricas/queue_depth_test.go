@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesCount returns the number of series collector currently exports.
+func seriesCount(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	n := 0
+	for range ch {
+		n++
+	}
+
+	return n
+}
+
+// TestUpdateQueueDepthsFailure polls a management API that answers once, then
+// fails, and checks the depth is dropped rather than kept at its last value,
+// with queue_depth_scrape_success reporting the failure.
+func TestUpdateQueueDepthsFailure(t *testing.T) {
+	setupMetrics(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	var down atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"messages":7}`))
+	}))
+	t.Cleanup(api.Close)
+	c := newManagementClient(api.URL, "user", "secret", "")
+
+	updateQueueDepths(context.Background(), c, []string{"machines"})
+	if got := gaugeValue(t, queueDepthMetric.WithLabelValues("machines")); got != 7 {
+		t.Errorf("queue_depth = %g, want 7", got)
+	}
+	if got := gaugeValue(t, queueDepthSuccessMetric.WithLabelValues("machines")); got != 1 {
+		t.Errorf("queue_depth_scrape_success = %g after a poll, want 1", got)
+	}
+
+	down.Store(true)
+	updateQueueDepths(context.Background(), c, []string{"machines"})
+	if n := seriesCount(queueDepthMetric); n != 0 {
+		t.Errorf("queue_depth kept %d series after a failed poll, want none", n)
+	}
+	if got := gaugeValue(t, queueDepthSuccessMetric.WithLabelValues("machines")); got != 0 {
+		t.Errorf("queue_depth_scrape_success = %g after a failed poll, want 0", got)
+	}
+
+	down.Store(false)
+	updateQueueDepths(context.Background(), c, []string{"machines"})
+	if got := gaugeValue(t, queueDepthMetric.WithLabelValues("machines")); got != 7 {
+		t.Errorf("queue_depth = %g once the API is back, want 7", got)
+	}
+}
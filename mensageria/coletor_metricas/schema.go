@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	schemaVersionHeader = "schema_version"
+
+	schemaV1 = "1"
+	schemaV2 = "2"
+)
+
+// errMisrouted is returned for a controller sensor batch ({"sensors": [...]})
+// delivered to the collector, which would otherwise decode into an empty
+// Message and push zeros.
+var errMisrouted = errors.New("sensor batch payload misrouted to the collector")
+
+type messageV2 struct {
+	Metadata Metadata `json:"metadata"`
+	Metrics  struct {
+		Coordinates struct {
+			Lat *float64 `json:"lat"`
+			Lon *float64 `json:"lon"`
+		} `json:"coordinates"`
+		Temperature   float64   `json:"temperature"`
+		CPUUsagePorc  float64   `json:"cpu_usage_porc"`
+		CPUCores      []float64 `json:"cpu_cores,omitempty"`
+		MemUsagePorc  float64   `json:"mem_usage_porc"`
+		MemUsageBytes int64     `json:"mem_usage_bytes"`
+	} `json:"metrics"`
+}
+
+// decodeMessage picks the decoder from the schema_version AMQP header, falling
+// back to a top level "version" JSON field and then to v1. Every version is
+// decoded into the same Message.
+func decodeMessage(delivery amqp.Delivery) (Message, error) {
+	if isSensorBatch(delivery.Body) {
+		return Message{}, errMisrouted
+	}
+
+	version, err := schemaVersion(delivery)
+	if err != nil {
+		return Message{}, err
+	}
+
+	switch version {
+	case schemaV1:
+		var msg Message
+		if err := json.Unmarshal(delivery.Body, &msg); err != nil {
+			return Message{}, err
+		}
+
+		return msg, nil
+
+	case schemaV2:
+		var v2 messageV2
+		if err := json.Unmarshal(delivery.Body, &v2); err != nil {
+			return Message{}, err
+		}
+
+		return Message{
+			Metadata: v2.Metadata,
+			Metrics: Metrics{
+				Coordinates: Coordinates{
+					Latitude:  formatCoordinate(v2.Metrics.Coordinates.Lat, "N", "S"),
+					Longitude: formatCoordinate(v2.Metrics.Coordinates.Lon, "E", "W"),
+				},
+				Temperature:   v2.Metrics.Temperature,
+				CPUUsagePorc:  v2.Metrics.CPUUsagePorc,
+				CPUCores:      v2.Metrics.CPUCores,
+				MemUsagePorc:  v2.Metrics.MemUsagePorc,
+				MemUsageBytes: v2.Metrics.MemUsageBytes,
+			},
+		}, nil
+	}
+
+	return Message{}, fmt.Errorf("unsupported schema version \"%s\"", version)
+}
+
+// isJSONArray peeks at the first non-whitespace byte of body to tell a batch
+// of reports apart from a single one.
+func isJSONArray(body []byte) bool {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	return len(body) > 0 && body[0] == '['
+}
+
+func isSensorBatch(body []byte) bool {
+	var probe struct {
+		Sensors  json.RawMessage `json:"sensors"`
+		Metadata json.RawMessage `json:"metadata"`
+		Metrics  json.RawMessage `json:"metrics"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return false
+	}
+
+	return probe.Sensors != nil && probe.Metadata == nil && probe.Metrics == nil
+}
+
+func schemaVersion(delivery amqp.Delivery) (string, error) {
+	if v, ok := delivery.Headers[schemaVersionHeader]; ok {
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case int8, int16, int32, int64, uint8, uint16, uint32, uint64, int:
+			return fmt.Sprintf("%d", v), nil
+		}
+
+		return "", fmt.Errorf("invalid %s header type %T", schemaVersionHeader, v)
+	}
+
+	var envelope struct {
+		Version json.RawMessage `json:"version"`
+	}
+	if err := json.Unmarshal(delivery.Body, &envelope); err != nil {
+		return "", err
+	}
+
+	if len(envelope.Version) == 0 {
+		return schemaV1, nil
+	}
+
+	var version string
+	if err := json.Unmarshal(envelope.Version, &version); err == nil {
+		return version, nil
+	}
+
+	var number int
+	if err := json.Unmarshal(envelope.Version, &number); err != nil {
+		return "", fmt.Errorf("invalid version field: %w", err)
+	}
+
+	return strconv.Itoa(number), nil
+}
+
+// formatCoordinate renders signed degrees in the v1 "<degrees> <cardinal
+// point>" form, using positive for non-negative values. A coordinate missing
+// from the message renders empty, so it is skipped like a missing v1 one
+// instead of being reported as 0.
+func formatCoordinate(value *float64, positive, negative string) string {
+	if value == nil {
+		return ""
+	}
+
+	degrees := *value
+	cardinalPoint := positive
+	if degrees < 0 {
+		cardinalPoint = negative
+	}
+
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(math.Abs(degrees), 'f', -1, 64), cardinalPoint)
+}
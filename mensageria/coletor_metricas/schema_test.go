@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDecodeMessageV1(t *testing.T) {
+	body := `{"metadata":{"name":"m1"},"metrics":{"coordinates":{"latitude":"23.5 S","longitude":"46.6 W"},"temperature":300}}`
+
+	msg, err := decodeMessage(amqp.Delivery{Body: []byte(body)})
+	if err != nil {
+		t.Fatalf("decodeMessage: %v", err)
+	}
+
+	if msg.Metadata.Name != "m1" || msg.Metrics.Coordinates.Latitude != "23.5 S" || msg.Metrics.Temperature != 300 {
+		t.Errorf("decodeMessage = %+v", msg)
+	}
+}
+
+func TestDecodeMessageV2(t *testing.T) {
+	body := `{"metadata":{"name":"m2"},"metrics":{"coordinates":{"lat":-23.5,"lon":46.6},"cpu_usage_porc":12}}`
+
+	for name, delivery := range map[string]amqp.Delivery{
+		"header":        {Headers: amqp.Table{schemaVersionHeader: int32(2)}, Body: []byte(body)},
+		"version field": {Body: []byte(`{"version":"2",` + body[1:])},
+	} {
+		msg, err := decodeMessage(delivery)
+		if err != nil {
+			t.Errorf("%s: decodeMessage: %v", name, err)
+			continue
+		}
+
+		coordinates := msg.Metrics.Coordinates
+		if coordinates.Latitude != "23.5 S" || coordinates.Longitude != "46.6 E" || msg.Metrics.CPUUsagePorc != 12 {
+			t.Errorf("%s: decodeMessage = %+v", name, msg)
+		}
+	}
+}
+
+// TestDecodeMessageV2MissingCoordinates checks that a v2 message without
+// coordinates is not reported at 0,0 (0 N, 0 E).
+func TestDecodeMessageV2MissingCoordinates(t *testing.T) {
+	body := `{"version":2,"metadata":{"name":"m2"},"metrics":{"coordinates":{"lat":0},"temperature":290}}`
+
+	msg, err := decodeMessage(amqp.Delivery{Body: []byte(body)})
+	if err != nil {
+		t.Fatalf("decodeMessage: %v", err)
+	}
+
+	if msg.Metrics.Coordinates.Latitude != "0 N" {
+		t.Errorf("latitude = %q, want \"0 N\"", msg.Metrics.Coordinates.Latitude)
+	}
+
+	if msg.Metrics.Coordinates.Longitude != "" {
+		t.Errorf("longitude = %q, want it empty", msg.Metrics.Coordinates.Longitude)
+	}
+
+	if _, _, err := parseCoordinate(msg.Metrics.Coordinates.Longitude); !errors.Is(err, errMissingCoordinate) {
+		t.Errorf("missing longitude parses as %v, want errMissingCoordinate", err)
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	if _, err := decodeMessage(amqp.Delivery{Body: []byte(`{"sensors":[]}`)}); !errors.Is(err, errMisrouted) {
+		t.Errorf("sensor batch: err = %v, want errMisrouted", err)
+	}
+
+	if _, err := decodeMessage(amqp.Delivery{Body: []byte(`{"version":"9"}`)}); err == nil {
+		t.Error("unsupported version was decoded")
+	}
+
+	if _, err := decodeMessage(amqp.Delivery{Headers: amqp.Table{schemaVersionHeader: 1.5}, Body: []byte(`{}`)}); err == nil {
+		t.Error("float schema_version header was accepted")
+	}
+}
+
+// TestDecodeMessageLargeMemUsage checks mem_usage_bytes past 4 GiB decodes
+// whole in both schema versions, whatever the size of int on the build.
+func TestDecodeMessageLargeMemUsage(t *testing.T) {
+	const bytes = 17179869184 // 16 GiB
+
+	for name, delivery := range map[string]amqp.Delivery{
+		"v1": {Body: []byte(`{"metadata":{"name":"m1"},"metrics":{"mem_usage_bytes":17179869184}}`)},
+		"v2": {Headers: amqp.Table{schemaVersionHeader: int32(2)}, Body: []byte(`{"metadata":{"name":"m1"},"metrics":{"mem_usage_bytes":17179869184}}`)},
+	} {
+		msg, err := decodeMessage(delivery)
+		if err != nil {
+			t.Errorf("%s: decodeMessage: %v", name, err)
+			continue
+		}
+
+		if msg.Metrics.MemUsageBytes != bytes {
+			t.Errorf("%s: mem_usage_bytes = %d, want %d", name, msg.Metrics.MemUsageBytes, int64(bytes))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// pushEnabled is PUSH_ENABLED. It only makes sense to turn it off while
+	// scrape is enabled.
+	pushEnabled = true
+
+	// scrape is nil unless METRICS_PORT is set.
+	scrape *scrapeCache
+)
+
+// scrapeCache keeps the last snapshot of every group, the grouping of a push
+// (machine_name, instance and, when enabled, geohash, plus EXTRA_LABELS). It
+// serves them with the grouping turned into labels, so a scrape sees the same
+// series as the Pushgateway holds.
+type scrapeCache struct {
+	mu     sync.Mutex
+	groups map[string]scrapeGroup
+}
+
+type scrapeGroup struct {
+	labels   []*dto.LabelPair
+	families []*dto.MetricFamily
+}
+
+func newScrapeCache() *scrapeCache {
+	return &scrapeCache{groups: map[string]scrapeGroup{}}
+}
+
+// store replaces the snapshot of the group of grouping, like a push replaces
+// the metrics of its group.
+func (c *scrapeCache) store(grouping map[string]string, snapshot map[string][]*dto.MetricFamily) {
+	labels := map[string]string{}
+	for name, value := range pushExtraLabels {
+		labels[name] = value
+	}
+	for name, value := range grouping {
+		labels[name] = value
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := make([]string, 0, len(names))
+	pairs := make([]*dto.LabelPair, 0, len(names))
+	for _, name := range names {
+		value := labels[name]
+		keys = append(keys, name+"="+value)
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+
+	var families []*dto.MetricFamily
+	for _, category := range metricCategories {
+		families = append(families, snapshot[category]...)
+	}
+
+	c.mu.Lock()
+	c.groups[strings.Join(keys, ",")] = scrapeGroup{labels: pairs, families: families}
+	c.mu.Unlock()
+}
+
+// Gather merges the snapshots of every group into one family per metric.
+func (c *scrapeCache) Gather() ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	merged := map[string]*dto.MetricFamily{}
+	for _, group := range c.groups {
+		for _, family := range group.families {
+			m, ok := merged[family.GetName()]
+			if !ok {
+				m = &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				merged[family.GetName()] = m
+			}
+
+			for _, metric := range family.Metric {
+				labels := append(slices.Clone(metric.Label), group.labels...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+				m.Metric = append(m.Metric, &dto.Metric{
+					Label:       labels,
+					Gauge:       metric.Gauge,
+					Counter:     metric.Counter,
+					Summary:     metric.Summary,
+					Untyped:     metric.Untyped,
+					Histogram:   metric.Histogram,
+					TimestampMs: metric.TimestampMs,
+				})
+			}
+		}
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, family := range merged {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+	return families, nil
+}
+
+func serveMetrics(port string, cache *scrapeCache) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(cache, promhttp.HandlerOpts{}))
+
+	go func() {
+		log.Printf("serving metrics on :%s/metrics", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestScrapeInstanceLabel checks every scraped series carries the INSTANCE_ID,
+// and that the collector-wide counters are exported once rather than once per
+// machine.
+func TestScrapeInstanceLabel(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+	scrape = newScrapeCache()
+	handle := newHandler()
+
+	for _, machine := range []string{"m1", "m2", "m3"} {
+		if err := handle(context.Background(), testMessage(t, machine, start)); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+
+	if err := pushInstance(context.Background()); err != nil {
+		t.Fatalf("pushInstance: %v", err)
+	}
+
+	families, err := scrape.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			instance := ""
+			for _, label := range metric.Label {
+				if label.GetName() == "instance" {
+					instance = label.GetValue()
+				}
+			}
+
+			if instance != "replica-1" {
+				t.Errorf("%s %v has instance %q, want \"replica-1\"", family.GetName(), metric.Label, instance)
+			}
+		}
+	}
+
+	if got := len(findFamily(families, "temperature").Metric); got != 3 {
+		t.Errorf("temperature has %d series, want one per machine", got)
+	}
+
+	if got := scrapedValue(t, "bytes_processed_total"); got == 0 {
+		t.Error("bytes_processed_total was not counted")
+	}
+}
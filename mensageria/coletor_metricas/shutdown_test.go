@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"broker"
+)
+
+// TestDefaultShutdownBudget checks the default grace period plus the last push
+// of the instance metrics fits within the default SHUTDOWN_TIMEOUT.
+func TestDefaultShutdownBudget(t *testing.T) {
+	if warning := broker.ShutdownTimeoutWarning(defaultShutdownTimeout, defaultShutdownGracePeriod, finalInstancePushTimeout); warning != "" {
+		t.Error(warning)
+	}
+}
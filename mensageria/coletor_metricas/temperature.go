@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+const (
+	temperatureUnitCelsius    = "C"
+	temperatureUnitFahrenheit = "F"
+)
+
+// temperatureUnit is the TEMPERATURE_UNIT producers report in. The temperature
+// gauge is always in Celsius.
+var temperatureUnit = temperatureUnitCelsius
+
+func parseTemperatureUnit(value string) (string, error) {
+	switch value {
+	case "":
+		return temperatureUnitCelsius, nil
+	case temperatureUnitCelsius, temperatureUnitFahrenheit:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("invalid TEMPERATURE_UNIT \"%s\": must be C or F", value)
+}
+
+// celsius converts a reading in temperatureUnit to Celsius, e.g. 212 F is 100 C.
+func celsius(temperature float64) float64 {
+	if temperatureUnit == temperatureUnitFahrenheit {
+		return (temperature - 32) * 5 / 9
+	}
+
+	return temperature
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseTemperatureUnit(t *testing.T) {
+	for value, want := range map[string]string{"": temperatureUnitCelsius, "C": temperatureUnitCelsius, "F": temperatureUnitFahrenheit} {
+		if got, err := parseTemperatureUnit(value); err != nil || got != want {
+			t.Errorf("parseTemperatureUnit(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"K", "c", "Fahrenheit"} {
+		if _, err := parseTemperatureUnit(value); err == nil {
+			t.Errorf("parseTemperatureUnit(%q) was accepted", value)
+		}
+	}
+}
+
+// TestTemperatureUnit sends the same reading in both units and checks the
+// gauge is always set in Celsius.
+func TestTemperatureUnit(t *testing.T) {
+	tests := []struct {
+		unit    string
+		reading float64
+		want    float64
+	}{
+		{temperatureUnitCelsius, 212, 212},
+		{temperatureUnitFahrenheit, 212, 100},
+		{temperatureUnitFahrenheit, 32, 0},
+		{temperatureUnitFahrenheit, -40, -40},
+	}
+
+	for _, tt := range tests {
+		start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		setupMetrics(t, start)
+		temperatureUnit = tt.unit
+		t.Cleanup(func() { temperatureUnit = temperatureUnitCelsius })
+
+		var msg Message
+		msg.Metadata.Name = "m1"
+		msg.Metrics.Coordinates = Coordinates{Latitude: "23.5 S", Longitude: "46.6 W"}
+		msg.Metrics.Temperature = tt.reading
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(t, amqp.Delivery{Body: body})
+
+		if got := gaugeValue(t, temperatureMetric.WithLabelValues()); got != tt.want {
+			t.Errorf("%g %s sets the temperature gauge to %g, want %g", tt.reading, tt.unit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+type windowBucket struct {
+	start   time.Time
+	success int
+	total   int
+}
+
+// ratioWindow keeps success/total counts over a rolling window split into
+// fixed size buckets, so old observations expire without keeping every sample.
+type ratioWindow struct {
+	mu         sync.Mutex
+	bucketSize time.Duration
+	buckets    []windowBucket
+}
+
+func newRatioWindow(window time.Duration, buckets int) *ratioWindow {
+	return &ratioWindow{
+		bucketSize: window / time.Duration(buckets),
+		buckets:    make([]windowBucket, buckets),
+	}
+}
+
+func (w *ratioWindow) observe(t time.Time, success bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	start := t.Truncate(w.bucketSize)
+	b := &w.buckets[(start.UnixNano()/int64(w.bucketSize))%int64(len(w.buckets))]
+	if !b.start.Equal(start) {
+		*b = windowBucket{start: start}
+	}
+
+	b.total++
+	if success {
+		b.success++
+	}
+}
+
+// ratio returns the success ratio of the observations inside the window
+// ending at t. With no observations it reports 1, as nothing failed.
+func (w *ratioWindow) ratio(t time.Time) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	oldest := t.Truncate(w.bucketSize).Add(-w.bucketSize * time.Duration(len(w.buckets)-1))
+	success, total := 0, 0
+	for _, b := range w.buckets {
+		if b.start.Before(oldest) || b.start.After(t) {
+			continue
+		}
+
+		success += b.success
+		total += b.total
+	}
+
+	if total == 0 {
+		return 1
+	}
+
+	return float64(success) / float64(total)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRatioWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := newRatioWindow(time.Minute, 6)
+
+	if got := w.ratio(start); got != 1 {
+		t.Errorf("empty window ratio = %g, want 1", got)
+	}
+
+	w.observe(start, true)
+	w.observe(start.Add(10*time.Second), false)
+	w.observe(start.Add(20*time.Second), true)
+	w.observe(start.Add(30*time.Second), true)
+
+	if got := w.ratio(start.Add(30 * time.Second)); got != 0.75 {
+		t.Errorf("ratio = %g, want 0.75", got)
+	}
+
+	// A minute later the first observations fell out of the window.
+	if got := w.ratio(start.Add(70 * time.Second)); got != 1 {
+		t.Errorf("ratio once the failure expired = %g, want 1", got)
+	}
+
+	// Reusing the bucket of an expired observation starts it over.
+	w.observe(start.Add(70*time.Second), false)
+	if got := w.ratio(start.Add(70 * time.Second)); got != 2.0/3 {
+		t.Errorf("ratio after reusing a bucket = %g, want 2/3", got)
+	}
+}
+
+func TestParseSuccessRatio(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setupMetrics(t, start)
+
+	send(t, testMessage(t, "m1", start))
+	sendMetrics(context.Background(), amqp.Delivery{Body: []byte("{not json")})
+
+	if got := gaugeValue(t, parseSuccessRatioMetric); got != 0.5 {
+		t.Errorf("parse_success_ratio = %g, want 0.5", got)
+	}
+}
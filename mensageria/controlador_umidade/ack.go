@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+const (
+	ackModeAlways  = "always"
+	ackModeSuccess = "success"
+)
+
+// ackMode is ACK_MODE. Deliveries are acked by the controller once handled,
+// rather than by the broker on delivery, so the ones in flight when it dies
+// are redelivered. With "always", the default, a handled delivery is acked
+// even if a publish failed: a message is never requeued, so irrigation that
+// already went out to some irrigators is not triggered again. With "success",
+// a delivery whose irrigate commands failed to publish is nacked and requeued
+// for another attempt. Messages dropped before any publish (oversized,
+// undecodable...) are acked in both modes, since a retry would fail again.
+var ackMode = ackModeAlways
+
+// errPublishFailed wraps every failure to publish an irrigate command or to
+// get it confirmed, the only failures ACK_MODE=success requeues.
+var errPublishFailed = errors.New("failed to publish message")
+
+func parseAckMode(value string) (string, error) {
+	switch value {
+	case "":
+		return ackModeAlways, nil
+	case ackModeAlways, ackModeSuccess:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("invalid ACK_MODE \"%s\": must be always or success", value)
+}
+
+// acknowledge settles each delivery once the rest of the chain is done with
+// it, according to ackMode.
+func acknowledge(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		err := next(ctx, delivery)
+
+		if ackMode == ackModeSuccess && errors.Is(err, errPublishFailed) {
+			if nackErr := delivery.Nack(false, true); nackErr != nil {
+				log.Printf("failed to nack delivery: %v", nackErr)
+			}
+			return err
+		}
+
+		if ackErr := delivery.Ack(false); ackErr != nil {
+			log.Printf("failed to ack delivery: %v", ackErr)
+		}
+		return err
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseAckMode(t *testing.T) {
+	for value, want := range map[string]string{"": ackModeAlways, "always": ackModeAlways, "success": ackModeSuccess} {
+		got, err := parseAckMode(value)
+		if err != nil || got != want {
+			t.Errorf("parseAckMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"never", "Success"} {
+		if _, err := parseAckMode(value); err == nil {
+			t.Errorf("parseAckMode(%q) was accepted", value)
+		}
+	}
+}
+
+// TestAcknowledge checks only a failed publish under ACK_MODE=success is
+// nacked, and requeued; every other outcome is acked.
+func TestAcknowledge(t *testing.T) {
+	publishErr := fmt.Errorf("%w in exchange \"all\": %w", errPublishFailed, amqp.ErrClosed)
+	decodeErr := errors.New("failed to decode message")
+
+	tests := []struct {
+		mode        string
+		err         error
+		acks, nacks int
+	}{
+		{ackModeAlways, nil, 1, 0},
+		{ackModeAlways, publishErr, 1, 0},
+		{ackModeSuccess, nil, 1, 0},
+		{ackModeSuccess, decodeErr, 1, 0},
+		{ackModeSuccess, publishErr, 0, 1},
+	}
+
+	for _, tt := range tests {
+		setupController(t, time.Now())
+		ackMode = tt.mode
+		ack := &fakeAcknowledger{}
+
+		handle := acknowledge(func(ctx context.Context, delivery amqp.Delivery) error { return tt.err })
+		if err := handle(context.Background(), amqp.Delivery{Acknowledger: ack}); err != tt.err {
+			t.Errorf("%s with %v: the handler returned %v", tt.mode, tt.err, err)
+		}
+
+		if acks, nacks := ack.settled(); acks != tt.acks || nacks != tt.nacks {
+			t.Errorf("%s with %v: got %d acks and %d nacks, want %d and %d", tt.mode, tt.err, acks, nacks, tt.acks, tt.nacks)
+		}
+		if tt.nacks > 0 && !ack.requeue {
+			t.Errorf("%s with %v: the delivery was nacked without requeue", tt.mode, tt.err)
+		}
+	}
+}
+
+// TestAckModeSuccessRequeuesFailedPublish runs deliveries through the whole
+// handler chain and checks one whose irrigate command failed to publish is
+// requeued, while an undecodable one is still acked.
+func TestAckModeSuccessRequeuesFailedPublish(t *testing.T) {
+	setupController(t, time.Now())
+	ackMode = ackModeSuccess
+	ch := newFakeChannel()
+	handle := newHandler(ch)
+
+	ch.publishErr = amqp.ErrClosed
+	failed := &fakeAcknowledger{}
+	handle(context.Background(), amqp.Delivery{Acknowledger: failed, Body: sensorMessage(t, "q1=10")})
+
+	if acks, nacks := failed.settled(); acks != 0 || nacks != 1 || !failed.requeue {
+		t.Errorf("failed publish: got %d acks and %d nacks (requeue %t), want it nacked and requeued", acks, nacks, failed.requeue)
+	}
+
+	ch.publishErr = nil
+	undecodable := &fakeAcknowledger{}
+	handle(context.Background(), amqp.Delivery{Acknowledger: undecodable, Body: []byte("not json")})
+
+	if acks, nacks := undecodable.settled(); acks != 1 || nacks != 0 {
+		t.Errorf("undecodable message: got %d acks and %d nacks, want it acked", acks, nacks)
+	}
+}
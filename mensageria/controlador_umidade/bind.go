@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+const (
+	defaultBindMaxRetries = 3
+	defaultBindBackoff    = 500 * time.Millisecond
+)
+
+var (
+	bindMaxRetries = defaultBindMaxRetries
+	bindBackoff    = defaultBindBackoff
+	sleep          = time.Sleep
+)
+
+type queueBinder interface {
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// bindWithRetry binds queue to exchange, retrying up to bindMaxRetries times
+// with an exponential backoff so a broker that is still starting up does not
+// require a full restart. A broker error is not retried: it is a channel
+// exception, the server closes the channel and any further attempt would only
+// fail with amqp.ErrClosed, hiding the real cause.
+func bindWithRetry(b queueBinder, queue, key, exchange string) error {
+	backoff := bindBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = b.QueueBind(
+			queue,
+			key,
+			exchange,
+			false,
+			nil,
+		)
+		if err == nil || attempt >= bindMaxRetries || closesChannel(err) {
+			break
+		}
+
+		log.Printf("failed to bind queue \"%s\" to exchange \"%s\" (attempt %d), retrying in %s: %v", queue, exchange, attempt+1, backoff, err)
+		sleep(backoff)
+		backoff *= 2
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w \"%s\" to exchange \"%s\" with routing key \"%s\": %w", broker.ErrQueueBind, queue, exchange, key, err)
+	}
+
+	return nil
+}
+
+// closesChannel reports whether err is an *amqp.Error, amqp.ErrClosed
+// included, after which the channel it came from can no longer be used.
+func closesChannel(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// errTransient stands in for a failure that leaves the channel open, such as
+// a timeout while the broker is starting up.
+var errTransient = errors.New("i/o timeout")
+
+// flakyBinder fails the first failures binds with err. Like a real channel,
+// once it has returned an *amqp.Error it is closed and every later bind fails
+// with amqp.ErrClosed.
+type flakyBinder struct {
+	failures int
+	err      error
+	calls    int
+	closed   bool
+}
+
+func (b *flakyBinder) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b.calls++
+	if b.closed {
+		return amqp.ErrClosed
+	}
+
+	if b.calls <= b.failures {
+		b.closed = closesChannel(b.err)
+		return b.err
+	}
+
+	return nil
+}
+
+// stubSleep replaces sleep for the test, recording each backoff.
+func stubSleep(t *testing.T) *[]time.Duration {
+	t.Helper()
+
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() {
+		sleep = time.Sleep
+		bindMaxRetries, bindBackoff = defaultBindMaxRetries, defaultBindBackoff
+	})
+
+	return &slept
+}
+
+func TestBindWithRetryRecovers(t *testing.T) {
+	slept := stubSleep(t)
+	bindMaxRetries, bindBackoff = 3, 100*time.Millisecond
+
+	b := &flakyBinder{failures: 2, err: errTransient}
+	if err := bindWithRetry(b, "irg-q1-001", "q1", "quadrants"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.calls != 3 {
+		t.Errorf("bound %d times, want 3", b.calls)
+	}
+	if fmt.Sprint(*slept) != "[100ms 200ms]" {
+		t.Errorf("backed off %v, want [100ms 200ms]", *slept)
+	}
+}
+
+func TestBindWithRetryGivesUp(t *testing.T) {
+	slept := stubSleep(t)
+	bindMaxRetries = 2
+
+	b := &flakyBinder{failures: 10, err: errTransient}
+	err := bindWithRetry(b, "irg-q1-001", "q1", "quadrants")
+	if !errors.Is(err, broker.ErrQueueBind) || !errors.Is(err, errTransient) {
+		t.Errorf("bindWithRetry = %v, want broker.ErrQueueBind wrapping the last failure", err)
+	}
+
+	if b.calls != 3 || len(*slept) != 2 {
+		t.Errorf("bound %d times with %d backoffs, want 3 and 2", b.calls, len(*slept))
+	}
+}
+
+// TestBindWithRetryChannelError checks a broker error, which closes the
+// channel, is reported at once rather than retried into amqp.ErrClosed.
+func TestBindWithRetryChannelError(t *testing.T) {
+	slept := stubSleep(t)
+	bindMaxRetries = 3
+
+	b := &flakyBinder{failures: 1, err: &amqp.Error{Code: amqp.NotFound, Reason: "no exchange"}}
+	err := bindWithRetry(b, "irg-q1-001", "q1", "quadrants")
+	if !errors.Is(err, broker.ErrQueueBind) {
+		t.Errorf("bindWithRetry = %v, want broker.ErrQueueBind", err)
+	}
+
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Errorf("the broker error is missing from %v", err)
+	}
+	if errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("the broker error was replaced by amqp.ErrClosed: %v", err)
+	}
+
+	if b.calls != 1 || len(*slept) != 0 {
+		t.Errorf("bound %d times with %d backoffs, want a single attempt", b.calls, len(*slept))
+	}
+}
+
+func TestClosesChannel(t *testing.T) {
+	for err, want := range map[error]bool{
+		&amqp.Error{Code: amqp.NotFound}:       true,
+		amqp.ErrClosed:                         true,
+		fmt.Errorf("bind: %w", amqp.ErrClosed): true,
+		errTransient:                           false,
+	} {
+		if got := closesChannel(err); got != want {
+			t.Errorf("closesChannel(%v) = %t, want %t", err, got, want)
+		}
+	}
+}
+
+// TestRegisterIrrigatorsReportsFailedBinds fails two binds of different
+// irrigators on transient errors and checks both are reported while every
+// other binding is still made.
+func TestRegisterIrrigatorsReportsFailedBinds(t *testing.T) {
+	setupController(t, time.Now())
+	stubSleep(t)
+	bindMaxRetries = 0
+
+	ch := newFakeChannel()
+	ch.bindErrs = map[string]error{
+		"quadrants/q1 -> irg-q1-001": errTransient,
+		"all/ -> irg-q2-001":         errTransient,
+	}
+
+	err := registerIrrigators(ch)
+	if !errors.Is(err, broker.ErrQueueBind) {
+		t.Fatalf("registerIrrigators = %v, want broker.ErrQueueBind", err)
+	}
+
+	for _, want := range []string{`"irg-q1-001" to exchange "quadrants"`, `"irg-q2-001" to exchange "all"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error does not report %s: %v", want, err)
+		}
+	}
+
+	for _, want := range []string{"all/ -> irg-q1-001", "irg-q1-001/irg-q1-001 -> irg-q1-001", "quadrants/q2 -> irg-q2-001", "all/ -> irg-q4-001"} {
+		if !slices.Contains(ch.bindings, want) {
+			t.Errorf("missing binding %s after the failures: %v", want, ch.bindings)
+		}
+	}
+}
+
+// TestRegisterIrrigatorsStopsOnChannelError fails a bind with a broker error,
+// which closes the channel, and checks registration stops there and reports
+// that error alone, not amqp.ErrClosed for the irrigators left.
+func TestRegisterIrrigatorsStopsOnChannelError(t *testing.T) {
+	setupController(t, time.Now())
+	slept := stubSleep(t)
+
+	ch := newFakeChannel()
+	ch.bindErrs = map[string]error{
+		"quadrants/q1 -> irg-q1-001": &amqp.Error{Code: amqp.NotFound, Reason: "no exchange"},
+	}
+
+	err := registerIrrigators(ch)
+	if !errors.Is(err, broker.ErrQueueBind) {
+		t.Fatalf("registerIrrigators = %v, want broker.ErrQueueBind", err)
+	}
+
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Errorf("the broker error is missing from %v", err)
+	}
+	if errors.Is(err, amqp.ErrClosed) || strings.Contains(err.Error(), "irg-q2-001") {
+		t.Errorf("failures on the closed channel were reported: %v", err)
+	}
+
+	if len(*slept) != 0 {
+		t.Errorf("backed off %v on a closed channel", *slept)
+	}
+	if fmt.Sprint(ch.bindings) != "[all/ -> irg-q1-001]" {
+		t.Errorf("bindings = %v, want only the one made before the failure", ch.bindings)
+	}
+}
+
+func TestRegisterIrrigatorsAllBound(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	if err := registerIrrigators(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each irrigator is bound to all, its quadrant and its own exchange.
+	if got, want := len(ch.bindings), 3*len(testIrrigators); got != want {
+		t.Errorf("got %d bindings, want %d: %v", got, want, ch.bindings)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+// channel is the subset of *amqp.Channel the controller uses to declare its
+// topology and publish irrigate commands, so the routing logic can run against
+// a fake channel that records publishes and feeds synthetic deliveries.
+type channel interface {
+	broker.Channel
+	queueBinder
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Confirm(noWait bool) error
+	Cancel(consumer string, noWait bool) error
+	PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error)
+}
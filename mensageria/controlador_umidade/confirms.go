@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	confirmModeOff   = "off"
+	confirmModeSync  = "sync"
+	confirmModeBatch = "batch"
+)
+
+type pendingConfirm struct {
+	cmd     irrigateCommand
+	confirm *amqp.DeferredConfirmation
+}
+
+func (p pendingConfirm) wait(ctx context.Context) error {
+	acked, err := p.confirm.WaitContext(ctx)
+	if err != nil {
+		recordCommandResult(p.cmd, commandResultFailure)
+		return fmt.Errorf("%w to exchange \"%s\" with routing key \"%s\": not confirmed: %w", errPublishFailed, p.cmd.exchange, p.cmd.key, err)
+	}
+
+	if !acked {
+		recordCommandResult(p.cmd, commandResultFailure)
+		return fmt.Errorf("%w to exchange \"%s\" with routing key \"%s\": nacked by the broker", errPublishFailed, p.cmd.exchange, p.cmd.key)
+	}
+
+	recordCommanded(p.cmd)
+	recordStopped(p.cmd)
+	recordIrrigated(p.cmd)
+	return nil
+}
+
+// confirmBatch collects the deferred confirmations of every publish made while
+// handling a single message, so they can be awaited together.
+type confirmBatch struct {
+	pending []pendingConfirm
+}
+
+func (b *confirmBatch) add(p pendingConfirm) {
+	b.pending = append(b.pending, p)
+}
+
+// wait blocks until every pending publish is confirmed or ctx is done. The
+// returned error lists each publish that was nacked or left unconfirmed.
+func (b *confirmBatch) wait(ctx context.Context) error {
+	errs := []error{}
+	for _, p := range b.pending {
+		if err := p.wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	b.pending = nil
+	return errors.Join(errs...)
+}
+
+// confirmTracker keeps every publish that has not been confirmed by the broker
+// yet, regardless of the context it was issued with, so shutdown can wait for
+// them after the per-message contexts are gone.
+type confirmTracker struct {
+	mu      sync.Mutex
+	pending map[*amqp.DeferredConfirmation]pendingConfirm
+}
+
+var outstandingConfirms = &confirmTracker{
+	pending: map[*amqp.DeferredConfirmation]pendingConfirm{},
+}
+
+func (t *confirmTracker) track(p pendingConfirm) {
+	t.mu.Lock()
+	t.pending[p.confirm] = p
+	t.mu.Unlock()
+
+	go func() {
+		<-p.confirm.Done()
+
+		t.mu.Lock()
+		delete(t.pending, p.confirm)
+		t.mu.Unlock()
+	}()
+}
+
+// waitAll waits up to timeout for every tracked publish to be confirmed and
+// returns the ones that were still unconfirmed when it gave up.
+func (t *confirmTracker) waitAll(timeout time.Duration) []pendingConfirm {
+	t.mu.Lock()
+	pending := make([]pendingConfirm, 0, len(t.pending))
+	for _, p := range t.pending {
+		pending = append(pending, p)
+	}
+	t.mu.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	unconfirmed := []pendingConfirm{}
+	for i, p := range pending {
+		select {
+		case <-p.confirm.Done():
+		case <-deadline.C:
+			return append(unconfirmed, pending[i:]...)
+		}
+	}
+
+	return unconfirmed
+}
+
+func parseConfirmMode(value string) (string, error) {
+	switch value {
+	case "":
+		return confirmModeOff, nil
+	case confirmModeOff, confirmModeSync, confirmModeBatch:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("invalid PUBLISH_CONFIRMS \"%s\": must be one of off, sync or batch", value)
+}
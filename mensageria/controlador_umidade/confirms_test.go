@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+func TestParseConfirmMode(t *testing.T) {
+	for value, want := range map[string]string{"": confirmModeOff, "off": confirmModeOff, "sync": confirmModeSync, "batch": confirmModeBatch} {
+		if got, err := parseConfirmMode(value); err != nil || got != want {
+			t.Errorf("parseConfirmMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := parseConfirmMode("always"); err == nil {
+		t.Error("parseConfirmMode accepted \"always\"")
+	}
+}
+
+func TestSetupEnablesConfirms(t *testing.T) {
+	setupController(t, time.Now())
+
+	for _, mode := range []string{confirmModeOff, confirmModeSync} {
+		confirmMode = mode
+		ch := newFakeChannel()
+		if _, _, err := setup(ch, []string{"sensors"}, broker.ConsumeOptions{Tag: "controller"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := mode != confirmModeOff; ch.confirms != want {
+			t.Errorf("with PUBLISH_CONFIRMS=%s, confirms enabled = %t, want %t", mode, ch.confirms, want)
+		}
+	}
+}
+
+// TestConfirmBatchUnconfirmed checks the batch wait reports every publish the
+// broker did not confirm before the context expired, as a failure.
+func TestConfirmBatchUnconfirmed(t *testing.T) {
+	setupController(t, time.Now())
+
+	cmd := irrigateCommand{exchange: "irg-q1-001", key: "irg-q1-001"}
+	failures := irrigatorCommandsMetric.WithLabelValues("irg-q1-001", commandResultFailure)
+	before := counterValue(t, failures)
+
+	var batch confirmBatch
+	batch.add(pendingConfirm{cmd: cmd, confirm: &amqp.DeferredConfirmation{}})
+	batch.add(pendingConfirm{cmd: cmd, confirm: &amqp.DeferredConfirmation{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := batch.wait(ctx)
+	if !errors.Is(err, errPublishFailed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait = %v, want the unconfirmed publishes reported", err)
+	}
+
+	if got := counterValue(t, failures) - before; got != 2 {
+		t.Errorf("counted %g failures, want 2", got)
+	}
+
+	if len(batch.pending) != 0 {
+		t.Errorf("%d confirmations are still pending after the wait", len(batch.pending))
+	}
+}
+
+func TestConfirmTrackerWaitAllTimesOut(t *testing.T) {
+	p := pendingConfirm{confirm: &amqp.DeferredConfirmation{}}
+	tracker := &confirmTracker{pending: map[*amqp.DeferredConfirmation]pendingConfirm{p.confirm: p}}
+
+	if unconfirmed := tracker.waitAll(10 * time.Millisecond); len(unconfirmed) != 1 {
+		t.Errorf("waitAll returned %d unconfirmed publishes, want 1", len(unconfirmed))
+	}
+
+	if unconfirmed := (&confirmTracker{pending: map[*amqp.DeferredConfirmation]pendingConfirm{}}).waitAll(time.Second); len(unconfirmed) != 0 {
+		t.Errorf("waitAll with nothing pending returned %d publishes", len(unconfirmed))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// irrigateCooldown is IRRIGATE_COOLDOWN, the minimum time between two irrigate
+// commands to the same irrigator, so a burst of messages cannot toggle a pump
+// many times per second. Zero disables it.
+var irrigateCooldown time.Duration
+
+// lastCommanded holds when each target was last sent a command, guarded by
+// lastCommandedMu since workers publish concurrently. Like the hysteresis
+// state it lives in memory only and starts empty after a restart.
+var (
+	lastCommanded   = map[string]time.Time{}
+	lastCommandedMu sync.Mutex
+)
+
+// coolingDown reports whether cmd has to be suppressed because every irrigator
+// it is routed to was sent a command less than IRRIGATE_COOLDOWN ago. A command
+// to "all" or to a quadrant reaches all of its targets, so it goes through as
+// soon as one of them is out of its cooldown. It only reads the state: the
+// cooldown starts with recordCommanded, once the command reached the broker.
+func coolingDown(cmd irrigateCommand) bool {
+	if irrigateCooldown <= 0 {
+		return false
+	}
+
+	lastCommandedMu.Lock()
+	defer lastCommandedMu.Unlock()
+
+	t := now()
+	for _, target := range cooldownTargets(cmd) {
+		if last, ok := lastCommanded[target]; !ok || t.Sub(last) >= irrigateCooldown {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordCommanded starts the cooldown of every target of cmd. It is called
+// next to recordIrrigated, so a publish that failed or was nacked does not
+// hold back the retry. Stop commands are never suppressed and are not
+// recorded either.
+func recordCommanded(cmd irrigateCommand) {
+	if irrigateCooldown <= 0 || cmd.stop {
+		return
+	}
+
+	lastCommandedMu.Lock()
+	defer lastCommandedMu.Unlock()
+
+	t := now()
+	for _, target := range cooldownTargets(cmd) {
+		lastCommanded[target] = t
+	}
+}
+
+// cooldownTargets are the irrigators cmd is routed to. Commands with no
+// irrigator target, such as the fallback ones, are tracked by exchange and
+// routing key.
+func cooldownTargets(cmd irrigateCommand) []string {
+	if targets := cmd.targets(); len(targets) > 0 {
+		return targets
+	}
+
+	return []string{cmd.exchange + "/" + cmd.key}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestIrrigateCooldown(t *testing.T) {
+	clock := setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	irrigateCooldown = time.Minute
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.takePublished(); len(got) != 1 {
+		t.Fatalf("first command: published to %v, want irg-q1-001", routes(got))
+	}
+
+	before := counterValue(t, irrigateSuppressedMetric)
+	*clock = clock.Add(30 * time.Second)
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.takePublished(); len(got) != 0 {
+		t.Errorf("command within the cooldown was published to %v", routes(got))
+	}
+	if got := counterValue(t, irrigateSuppressedMetric) - before; got != 1 {
+		t.Errorf("irrigate_suppressed_total grew by %g, want 1", got)
+	}
+
+	*clock = clock.Add(30 * time.Second)
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.takePublished(); len(got) != 1 {
+		t.Errorf("command after the cooldown: published to %v, want irg-q1-001", routes(got))
+	}
+}
+
+// TestIrrigateCooldownAfterFailedPublish checks a publish that failed does not
+// start the cooldown, so the next message retries right away.
+func TestIrrigateCooldownAfterFailedPublish(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	irrigateCooldown = time.Minute
+	ch := newFakeChannel()
+
+	ch.publishErr = amqp.ErrClosed
+	if err := trigger(t, ch, "q1=10"); err == nil {
+		t.Fatal("publish error was not returned")
+	}
+
+	ch.publishErr = nil
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.takePublished(); len(got) != 1 {
+		t.Errorf("retry after a failed publish: published to %v, want irg-q1-001", routes(got))
+	}
+}
+
+// TestIrrigateCooldownQuadrant checks a command reaching several irrigators is
+// suppressed only while all of them are cooling down.
+func TestIrrigateCooldownQuadrant(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	irrigateCooldown = time.Minute
+
+	cmd := irrigateCommand{exchange: exchangeQuadrants, key: "q1"}
+	if coolingDown(cmd) {
+		t.Fatal("a command with no previous one is cooling down")
+	}
+
+	recordCommanded(cmd)
+	if !coolingDown(cmd) {
+		t.Error("a second command within the cooldown is not cooling down")
+	}
+
+	if coolingDown(irrigateCommand{exchange: exchangeQuadrants, key: "q2"}) {
+		t.Error("the cooldown of q1 held back q2")
+	}
+
+	recordCommanded(irrigateCommand{exchange: exchangeQuadrants, key: "q3", stop: true})
+	if coolingDown(irrigateCommand{exchange: exchangeQuadrants, key: "q3"}) {
+		t.Error("a stop command started the cooldown")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidateExchanges(t *testing.T) {
+	tests := []struct {
+		all, quadrants, fallback string
+		wantErr                  bool
+	}{
+		{"all", "quadrants", "", false},
+		{"ns.all", "ns.quadrants", "", false},
+		{"all", "quadrants", "unrouted", false},
+		{"commands", "commands", "", true},
+		{"irg-q1-001", "quadrants", "", true},
+		{"all", "irg-q2-001", "", true},
+		{"all", "quadrants", "all", true},
+		{"all", "quadrants", "quadrants", true},
+		{"all", "quadrants", "irg-q3-001", true},
+	}
+
+	for _, tt := range tests {
+		err := validateExchanges(tt.all, tt.quadrants, tt.fallback, testIrrigators)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateExchanges(%q, %q, %q) = %v, want error %t", tt.all, tt.quadrants, tt.fallback, err, tt.wantErr)
+		}
+	}
+}
+
+// useExchanges renames the broadcast and quadrant exchanges for the test,
+// restoring the defaults once it is done.
+func useExchanges(t *testing.T, all, quadrants string) {
+	t.Helper()
+
+	defaultAll, defaultQuadrants := exchangeAll, exchangeQuadrants
+	exchangeAll, exchangeQuadrants = all, quadrants
+	t.Cleanup(func() { exchangeAll, exchangeQuadrants = defaultAll, defaultQuadrants })
+}
+
+// TestRenamedExchanges checks the exchanges named by EXCHANGE_ALL and
+// EXCHANGE_QUADRANTS are the ones declared, bound and published to.
+func TestRenamedExchanges(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	useExchanges(t, "ns.all", "ns.quadrants")
+	ch := newFakeChannel()
+
+	if err := registerExchanges(ch); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(ch.exchanges); got != "[ns.all (fanout) ns.quadrants (topic)]" {
+		t.Errorf("declared exchanges = %s", got)
+	}
+
+	if err := registerIrrigators(ch); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ns.all/ -> irg-q1-001", "ns.quadrants/q1 -> irg-q1-001"} {
+		if !slices.Contains(ch.bindings, want) {
+			t.Errorf("missing binding %s: %v", want, ch.bindings)
+		}
+	}
+	for _, binding := range ch.bindings {
+		if binding == "all/ -> irg-q1-001" || binding == "quadrants/q1 -> irg-q1-001" {
+			t.Errorf("irrigator still bound to the default exchange: %s", binding)
+		}
+	}
+
+	quadrant := []Sensor{
+		{Id: "001", Location: "q3", AverageMoisture: 10},
+		{Id: "002", Location: "q3", AverageMoisture: 10},
+	}
+	if err := triggerSensors(t, ch, quadrant); err != nil {
+		t.Fatal(err)
+	}
+	if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q4=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[ns.quadrants/q3 ns.all/]" {
+		t.Errorf("routes = %v, want the quadrant and broadcast commands on the renamed exchanges", got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// publishing is a publish recorded by fakeChannel.
+type publishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// fakeChannel stands in for *amqp.Channel: it records the topology declared,
+// the consumers registered and the commands published, fails the publishes
+// while publishErr is set and the bindings listed in bindErrs, and feeds the
+// deliveries sent to its deliveries channel to every consumer. Like a real
+// channel, a bind failing with an *amqp.Error closes it: every later call
+// fails with amqp.ErrClosed.
+type fakeChannel struct {
+	mu         sync.Mutex
+	published  []publishing
+	exchanges  []string
+	bindings   []string
+	consumed   []string
+	cancelled  []string
+	confirms   bool
+	publishErr error
+	bindErrs   map[string]error
+	closed     bool
+
+	deliveries chan amqp.Delivery
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{deliveries: make(chan amqp.Delivery)}
+}
+
+func (f *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.consumed = append(f.consumed, consumer+" <- "+queue)
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return amqp.ErrClosed
+	}
+
+	binding := exchange + "/" + key + " -> " + name
+	if err := f.bindErrs[binding]; err != nil {
+		f.closed = closesChannel(err)
+		return err
+	}
+
+	f.bindings = append(f.bindings, binding)
+	return nil
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return amqp.ErrClosed
+	}
+
+	f.exchanges = append(f.exchanges, name+" ("+kind+")")
+	return nil
+}
+
+func (f *fakeChannel) Confirm(noWait bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.confirms = true
+	return nil
+}
+
+func (f *fakeChannel) Cancel(consumer string, noWait bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cancelled = append(f.cancelled, consumer)
+	return nil
+}
+
+// PublishWithDeferredConfirmWithContext records the publish, unless ctx is
+// done. It never returns a deferred confirmation, like a channel without
+// publisher confirms.
+func (f *fakeChannel) PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if f.publishErr != nil {
+		return nil, f.publishErr
+	}
+
+	f.published = append(f.published, publishing{exchange: exchange, key: key, msg: msg})
+	return nil, nil
+}
+
+// takePublished returns the publishes recorded since the last call.
+func (f *fakeChannel) takePublished() []publishing {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	published := f.published
+	f.published = nil
+	return published
+}
+
+// fakeAcknowledger records how deliveries were settled.
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	acks    int
+	nacks   int
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (a *fakeAcknowledger) settled() (acks, nacks int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.acks, a.nacks
+}
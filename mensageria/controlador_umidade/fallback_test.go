@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTriggerIrrigatorsFallback(t *testing.T) {
+	setupController(t, time.Now())
+	fallbackExchange = "fallback"
+	ch := newFakeChannel()
+
+	before := counterValue(t, fallbackPublishesMetric)
+	if err := trigger(t, ch, "q9=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[fallback/001]" {
+		t.Errorf("published to %v, want the fallback keyed by the sensor Id", got)
+	}
+
+	if got := counterValue(t, fallbackPublishesMetric) - before; got != 1 {
+		t.Errorf("fallback publishes grew by %g, want 1", got)
+	}
+}
+
+// TestTriggerIrrigatorsOrphanNotCountedForBroadcast checks an orphan sensor
+// does not make three dry quadrants look like all four.
+func TestTriggerIrrigatorsOrphanNotCountedForBroadcast(t *testing.T) {
+	setupController(t, time.Now())
+	fallbackExchange = "fallback"
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q9=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[irg-q1-001/irg-q1-001 irg-q2-001/irg-q2-001 irg-q3-001/irg-q3-001 fallback/001]"
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != want {
+		t.Errorf("published to %v, want %s", got, want)
+	}
+}
+
+// TestTriggerIrrigatorsBroadcastWithOrphan checks every irrigator being needed
+// still broadcasts when an orphan sensor is dry too, with the orphan sent to
+// the fallback on its own.
+func TestTriggerIrrigatorsBroadcastWithOrphan(t *testing.T) {
+	setupController(t, time.Now())
+	fallbackExchange = "fallback"
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q4=10", "q9=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[all/ fallback/001]" {
+		t.Errorf("published to %v, want a broadcast and the fallback", got)
+	}
+}
+
+// TestTriggerIrrigatorsFallbackUnknownSensor covers a sensor of a known
+// quadrant whose Id has no irrigator in IRRIGATORS_LIST.
+func TestTriggerIrrigatorsFallbackUnknownSensor(t *testing.T) {
+	setupController(t, time.Now())
+	fallbackExchange = "fallback"
+	ch := newFakeChannel()
+
+	if err := triggerSensors(t, ch, []Sensor{{Id: "999", Location: "q1", AverageMoisture: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[fallback/999]" {
+		t.Errorf("published to %v, want the fallback keyed by the sensor Id", got)
+	}
+}
+
+// TestTriggerIrrigatorsFallbackOff checks orphan commands keep the route they
+// always had while FALLBACK_EXCHANGE is unset.
+func TestTriggerIrrigatorsFallbackOff(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	before := counterValue(t, fallbackPublishesMetric)
+	if err := triggerSensors(t, ch, []Sensor{{Id: "999", Location: "q1", AverageMoisture: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := trigger(t, ch, "q9=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-999/irg-q1-999 irg-q9-001/irg-q9-001]" {
+		t.Errorf("published to %v without a fallback exchange, want the irrigator routes", got)
+	}
+
+	if got := counterValue(t, fallbackPublishesMetric) - before; got != 0 {
+		t.Errorf("fallback publishes grew by %g without a fallback exchange", got)
+	}
+}
+
+// TestTriggerIrrigatorsFallbackLocation checks a location with several sensors
+// and no irrigator goes to the fallback keyed by the location.
+func TestTriggerIrrigatorsFallbackLocation(t *testing.T) {
+	setupController(t, time.Now())
+	fallbackExchange = "fallback"
+	ch := newFakeChannel()
+
+	sensors := []Sensor{
+		{Id: "001", Location: "q9", AverageMoisture: 10},
+		{Id: "002", Location: "q9", AverageMoisture: 10},
+	}
+	if err := triggerSensors(t, ch, sensors); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[fallback/q9]" {
+		t.Errorf("published to %v, want the fallback keyed by the location", got)
+	}
+}
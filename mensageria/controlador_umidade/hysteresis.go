@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Sensors report moisture as a percentage, so readings are expected in
+// [minMoisture, maxMoisture]. The range is 0-100 and not the [0, 1] one first
+// asked for: the aggregator sends AverageMoisture as a percentage, and a
+// threshold checked against [0, 1] would flag every sane configuration.
+const (
+	minMoisture = 0
+	maxMoisture = 100
+)
+
+// moistureHysteresis is the MOISTURE_HYSTERESIS band around the threshold. A
+// sensor starts being irrigated at or below threshold - band and is only
+// considered satisfied above threshold + band; inside the band it keeps the
+// previous decision.
+var moistureHysteresis float64
+
+// irrigating holds the sensors whose last decision was to irrigate, keyed by
+// location and Id, guarded by irrigatingMu since workers handle messages
+// concurrently. The state lives in memory only: after a restart every sensor
+// starts as satisfied, so one reading inside the band is not irrigated until it
+// drops to threshold - band.
+var (
+	irrigating   = map[string]bool{}
+	irrigatingMu sync.Mutex
+)
+
+// underThreshold reports whether sensor needs irrigation, updating its
+// hysteresis state. With a zero band it is simply AverageMoisture <= threshold.
+// Calling it again with the same reading gives the same answer.
+func underThreshold(sensor Sensor) bool {
+	key := sensor.Location + "/" + sensor.Id
+
+	irrigatingMu.Lock()
+	defer irrigatingMu.Unlock()
+
+	switch {
+	case sensor.AverageMoisture <= moistureThreshold-moistureHysteresis:
+		irrigating[key] = true
+	case sensor.AverageMoisture > moistureThreshold+moistureHysteresis:
+		delete(irrigating, key)
+	}
+
+	return irrigating[key]
+}
+
+// checkMoistureConfig lists what looks like a misconfiguration of the
+// threshold and hysteresis band, against the percentage sensors report: a
+// threshold outside the range, or given as a fraction, and a band that makes
+// one of the two decisions unreachable.
+func checkMoistureConfig(threshold, band float64) []string {
+	var problems []string
+	if threshold < minMoisture || threshold > maxMoisture {
+		problems = append(problems, fmt.Sprintf("MOISTURE_THRESHOLD %g is outside the %d-%d%% range sensors report", threshold, minMoisture, maxMoisture))
+	} else if threshold > 0 && threshold <= 1 {
+		problems = append(problems, fmt.Sprintf("MOISTURE_THRESHOLD %g looks like a fraction, but sensors report a percentage", threshold))
+	}
+
+	if threshold-band < minMoisture {
+		problems = append(problems, fmt.Sprintf("MOISTURE_THRESHOLD - MOISTURE_HYSTERESIS (%g) is below %d, no reading starts irrigation", threshold-band, minMoisture))
+	}
+
+	if threshold+band >= maxMoisture {
+		problems = append(problems, fmt.Sprintf("MOISTURE_THRESHOLD + MOISTURE_HYSTERESIS (%g) is not below %d, an irrigated sensor is never satisfied", threshold+band, maxMoisture))
+	}
+
+	return problems
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUnderThresholdWithoutBand(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	for moisture, want := range map[float64]bool{29: true, 30: true, 30.1: false, 50: false} {
+		if got := underThreshold(Sensor{Id: "001", Location: "q1", AverageMoisture: moisture}); got != want {
+			t.Errorf("underThreshold(%g) = %t, want %t", moisture, got, want)
+		}
+	}
+}
+
+// TestUnderThresholdNoFlapping feeds a sensor readings crossing the threshold
+// back and forth inside the band and checks the decision only changes at its
+// edges.
+func TestUnderThresholdNoFlapping(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	moistureHysteresis = 5
+
+	readings := []struct {
+		moisture float64
+		want     bool
+	}{
+		{28, false}, // inside the band, starting satisfied
+		{31, false},
+		{25, true}, // threshold - band starts irrigation
+		{29, true},
+		{32, true},
+		{28, true},
+		{35, true}, // threshold + band is still inside
+		{35.5, false},
+		{31, false},
+		{27, false},
+	}
+
+	for i, r := range readings {
+		if got := underThreshold(Sensor{Id: "001", Location: "q1", AverageMoisture: r.moisture}); got != r.want {
+			t.Errorf("reading %d (%g): underThreshold = %t, want %t", i, r.moisture, got, r.want)
+		}
+	}
+}
+
+// TestUnderThresholdPerSensor checks each sensor of a location keeps its own
+// decision.
+func TestUnderThresholdPerSensor(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	moistureHysteresis = 5
+
+	underThreshold(Sensor{Id: "001", Location: "q1", AverageMoisture: 20})
+
+	if !underThreshold(Sensor{Id: "001", Location: "q1", AverageMoisture: 30}) {
+		t.Error("the irrigated sensor was satisfied inside the band")
+	}
+	if underThreshold(Sensor{Id: "002", Location: "q1", AverageMoisture: 30}) {
+		t.Error("another sensor of the location took the decision of the irrigated one")
+	}
+	if underThreshold(Sensor{Id: "001", Location: "q2", AverageMoisture: 30}) {
+		t.Error("a sensor with the same Id in another location took its decision")
+	}
+}
+
+// TestTriggerIrrigatorsHysteresis checks a location hovering around the
+// threshold is irrigated on every message once it dropped below the band,
+// instead of flapping.
+func TestTriggerIrrigatorsHysteresis(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	moistureHysteresis = 5
+	ch := newFakeChannel()
+
+	for _, reading := range []string{"q1=29", "q1=31"} {
+		if err := trigger(t, ch, reading); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := routes(ch.takePublished()); len(got) != 0 {
+		t.Errorf("readings inside the band published %v before any irrigation", got)
+	}
+
+	for _, reading := range []string{"q1=24", "q1=31", "q1=29", "q1=34"} {
+		if err := trigger(t, ch, reading); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001 irg-q1-001/irg-q1-001 irg-q1-001/irg-q1-001 irg-q1-001/irg-q1-001]" {
+		t.Errorf("published %v, want q1 irrigated on every reading once dry", got)
+	}
+}
+
+func TestCheckMoistureConfig(t *testing.T) {
+	tests := []struct {
+		threshold, band float64
+		problems        int
+	}{
+		{30, 0, 0},
+		{30, 5, 0},
+		{0.3, 0, 1},
+		{120, 0, 2},
+		{-1, 0, 2},
+		{30, 40, 1},
+		{95, 10, 1},
+	}
+
+	for _, tt := range tests {
+		if got := checkMoistureConfig(tt.threshold, tt.band); len(got) != tt.problems {
+			t.Errorf("checkMoistureConfig(%g, %g) = %q, want %d problems", tt.threshold, tt.band, got, tt.problems)
+		}
+	}
+}
@@ -8,12 +8,19 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"broker"
 )
 
 type Sensor struct {
@@ -23,103 +30,818 @@ type Sensor struct {
 	AverageMoisture float64
 }
 
+// UnmarshalJSON accepts AverageMoisture both as a JSON number and as a string
+// holding one (e.g. "42.5"), since producers disagree on the encoding.
+func (s *Sensor) UnmarshalJSON(data []byte) error {
+	type plain Sensor
+	var raw struct {
+		plain
+		AverageMoisture json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*s = Sensor(raw.plain)
+	if len(raw.AverageMoisture) == 0 || string(raw.AverageMoisture) == "null" {
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(raw.AverageMoisture, &value); err != nil {
+		return json.Unmarshal(raw.AverageMoisture, &s.AverageMoisture)
+	}
+
+	moisture, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return fmt.Errorf("invalid AverageMoisture \"%s\": %w", value, err)
+	}
+	s.AverageMoisture = moisture
+
+	return nil
+}
+
+// Message is the batch published by the aggregator, {"sensors": [...]}.
+// encoding/json matches keys case-insensitively, so "Sensors" parses too: the
+// tag only spells out the key producers actually send.
 type Message struct {
-	Sensors []Sensor
+	Sensors []Sensor `json:"sensors"`
 }
 
+const (
+	consumerTagPrefix = "controller"
+
+	defaultPublishTimeout         = 5 * time.Second
+	defaultShutdownGracePeriod    = 5 * time.Second
+	defaultShutdownTimeout        = 10 * time.Second
+	defaultConfirmShutdownTimeout = 3 * time.Second
+	defaultReconnectBackoff       = time.Second
+	defaultReconnectMaxBackoff    = 30 * time.Second
+	defaultPrefetchCount          = 10
+	defaultMaxMessageBytes        = 1 << 20
+	defaultWorkerCount            = 1
+)
+
 var (
-	moistureThreshold float64
-	irrigators = strings.Split(os.Getenv("IRRIGATORS_LIST"), ",")
+	moistureThreshold      float64
+	publishTimeout         time.Duration
+	shutdownGracePeriod    time.Duration
+	dryRun                 bool
+	debug                  bool
+	confirmMode            string
+	confirmShutdownTimeout time.Duration
+	publishLimiter         *tokenBucket
+	reconnectBackoff       broker.Backoff
+	maxMessageBytes        int
+	expectedContentType    string
+	messageSchema          *broker.Schema
+	workerCount            int
+	tracer                 = otel.Tracer("controlador-umidade")
+	irrigators             []string
+	fallbackExchange       string
+	operations             = broker.NewOperations()
+
+	// exchangeAll and exchangeQuadrants are EXCHANGE_ALL and
+	// EXCHANGE_QUADRANTS, so controllers sharing a broker can namespace them.
+	exchangeAll       = "all"
+	exchangeQuadrants = "quadrants"
 )
 
+var configEnvVars = append([]string{
+	"RABBITMQ_QUEUE",
+	"IRRIGATORS_LIST",
+	"FALLBACK_EXCHANGE",
+	"EXCHANGE_ALL",
+	"EXCHANGE_QUADRANTS",
+	"ROLE",
+	"PROMOTE_TOKEN",
+	"METRICS_PORT",
+	"MOISTURE_THRESHOLD",
+	"MOISTURE_HYSTERESIS",
+	"MOISTURE_CONFIG_STRICT",
+	"PUBLISH_TIMEOUT",
+	"SHUTDOWN_GRACE_PERIOD",
+	"SHUTDOWN_TIMEOUT",
+	"WORKER_COUNT",
+	"DRY_RUN",
+	"DEBUG",
+	"BIND_MAX_RETRIES",
+	"BIND_BACKOFF",
+	"PUBLISH_RATE_LIMIT",
+	"IRRIGATE_COOLDOWN",
+	"SEND_STOP",
+	"PUBLISH_CONFIRMS",
+	"ACK_MODE",
+	"CONFIRM_SHUTDOWN_TIMEOUT",
+	"MAX_MESSAGE_BYTES",
+	"EXPECT_CONTENT_TYPE",
+	"EXTRA_LABELS",
+	"PAYLOAD_FORMAT",
+	"IRRIGATE_CONTENT_TYPE",
+	"IRRIGATION_DURATION",
+	"IRRIGATION_DURATION_PER_POINT",
+	"IRRIGATION_MIN_DURATION",
+	"IRRIGATION_MAX_DURATION",
+}, broker.EnvVars...)
+
 func main() {
-	username := os.Getenv("RABBITMQ_USERNAME")
-	password := os.Getenv("RABBITMQ_PASSWORD")
-	host := os.Getenv("RABBITMQ_HOST")
-	port := os.Getenv("RABBITMQ_PORT")
-	queue := os.Getenv("RABBITMQ_QUEUE")
+	if err := broker.ParseFlags(configEnvVars); err != nil {
+		log.Fatal(err.Error())
+	}
 
-	var err error
-	moistureThreshold, err = strconv.ParseFloat(os.Getenv("MOISTURE_THRESHOLD"), 64)
+	switch broker.Command() {
+	case "":
+	case "ping":
+		cfg, err := broker.ConfigFromEnv()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if err := broker.Ping(cfg); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case "replay":
+		if len(broker.CommandArgs()) != 1 {
+			log.Fatal("usage: replay <file.ndjson>")
+		}
+
+		cfg, err := broker.ConfigFromEnv()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		opts, err := broker.ReplayOptionsFromEnv(broker.ParseQueues(os.Getenv("RABBITMQ_QUEUE")))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if err := broker.ReplayFile(cfg, broker.CommandArgs()[0], opts); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	default:
+		log.Fatalf("unknown command \"%s\"", broker.Command())
+	}
+	broker.LogBuildInfo("controlador-umidade")
+	broker.LogConfig(configEnvVars)
+
+	queues := broker.ParseQueues(os.Getenv("RABBITMQ_QUEUE"))
+	if len(queues) == 0 {
+		log.Fatal("RABBITMQ_QUEUE must list at least one queue")
+	}
+
+	list, err := parseIrrigators(os.Getenv("IRRIGATORS_LIST"))
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	irrigators = list
+	fallbackExchange = os.Getenv("FALLBACK_EXCHANGE")
+
+	exchangeAll = getEnv("EXCHANGE_ALL", exchangeAll)
+	exchangeQuadrants = getEnv("EXCHANGE_QUADRANTS", exchangeQuadrants)
+	if err := validateExchanges(exchangeAll, exchangeQuadrants, fallbackExchange, irrigators); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("exchanges: all=\"%s\" quadrants=\"%s\"", exchangeAll, exchangeQuadrants)
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%s/", username, password, host, port))
+	shutdownTracing, err := broker.InitTracing(context.Background(), "controlador-umidade")
 	if err != nil {
-		log.Fatalf("failed to connect to rabbitmq: %v", err)
+		log.Fatal(err.Error())
 	}
+	defer shutdownTracing(context.Background())
 
-	ch, err := conn.Channel()
+	role, err := parseRole(os.Getenv("ROLE"))
 	if err != nil {
-		log.Fatalf("failed to open a channel: %v", err)
+		log.Fatal(err.Error())
+	}
+	setStandby(role == roleStandby)
+	log.Printf("role: %s", role)
+	promoteToken = os.Getenv("PROMOTE_TOKEN")
+	if promoteToken == "" {
+		log.Println("PROMOTE_TOKEN is not set, /promote is disabled: send SIGUSR1 to promote")
 	}
 
-	msgsCh, err := registerConsumer(ch, queue)
+	extraLabels, err := parseExtraLabels(os.Getenv("EXTRA_LABELS"))
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	registerMetrics(extraLabels)
 
-	if err := registerExchanges(ch); err != nil {
+	moistureThreshold, err = parseMoistureThreshold(os.Getenv("MOISTURE_THRESHOLD"))
+	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	if err := registerIrrigators(ch); err != nil {
+	moistureHysteresis, err = parseFloat("MOISTURE_HYSTERESIS", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("moisture threshold: %g", moistureThreshold)
+	if moistureHysteresis > 0 {
+		log.Printf("moisture hysteresis: irrigate at or below %g, satisfied above %g", moistureThreshold-moistureHysteresis, moistureThreshold+moistureHysteresis)
+	}
+
+	moistureConfigStrict, err := parseBool("MOISTURE_CONFIG_STRICT", false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if problems := checkMoistureConfig(moistureThreshold, moistureHysteresis); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("warning: %s", problem)
+		}
+		if moistureConfigStrict {
+			log.Fatal("implausible moisture configuration with MOISTURE_CONFIG_STRICT set")
+		}
+	}
+
+	payloadFormat, err = parsePayloadFormat(os.Getenv("PAYLOAD_FORMAT"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	irrigateContentType, err = parseContentType(os.Getenv("IRRIGATE_CONTENT_TYPE"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	irrigationDuration, err = parseDuration("IRRIGATION_DURATION", defaultIrrigationDuration)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("payload format: %s, content type: %s, irrigation duration: %s", payloadFormat, contentTypeFor(payloadFormat), irrigationDuration)
+
+	irrigationDurationPerPoint, err = parseDuration("IRRIGATION_DURATION_PER_POINT", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	irrigationMinDuration, err = parseDuration("IRRIGATION_MIN_DURATION", defaultIrrigationMinDuration)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	irrigationMaxDuration, err = parseDuration("IRRIGATION_MAX_DURATION", defaultIrrigationMaxDuration)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if irrigationMinDuration > irrigationMaxDuration {
+		log.Fatalf("invalid IRRIGATION_MIN_DURATION \"%s\": must not exceed IRRIGATION_MAX_DURATION (%s)", irrigationMinDuration, irrigationMaxDuration)
+	}
+	if irrigationDurationPerPoint > 0 {
+		log.Printf("irrigation duration: %s per point of moisture deficit, between %s and %s", irrigationDurationPerPoint, irrigationMinDuration, irrigationMaxDuration)
+	}
+
+	publishTimeout, err = parseDuration("PUBLISH_TIMEOUT", defaultPublishTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("publish timeout: %s", publishTimeout)
+
+	shutdownGracePeriod, err = parseDuration("SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	shutdownTimeout, err := parseDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	workerCount, err = parseInt("WORKER_COUNT", defaultWorkerCount)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	dryRun, err = parseBool("DRY_RUN", false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if dryRun {
+		log.Println("dry-run mode enabled, irrigate commands will only be logged")
+	}
+
+	debug, err = parseBool("DEBUG", false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	bindMaxRetries, err = parseInt("BIND_MAX_RETRIES", defaultBindMaxRetries)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	bindBackoff, err = parseDuration("BIND_BACKOFF", defaultBindBackoff)
+	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	publishRateLimit, err := parseFloat("PUBLISH_RATE_LIMIT", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if publishRateLimit > 0 {
+		publishLimiter = newTokenBucket(publishRateLimit, time.Now)
+		log.Printf("publish rate limit: %g/s", publishRateLimit)
+	}
+
+	irrigateCooldown, err = parseDuration("IRRIGATE_COOLDOWN", 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if irrigateCooldown > 0 {
+		log.Printf("irrigate cooldown: %s", irrigateCooldown)
+	}
+
+	sendStop, err = parseBool("SEND_STOP", false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := validateSendStop(sendStop, payloadFormat); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("send stop: %t", sendStop)
+
+	confirmMode, err = parseConfirmMode(os.Getenv("PUBLISH_CONFIRMS"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("publisher confirms: %s", confirmMode)
+
+	ackMode, err = parseAckMode(os.Getenv("ACK_MODE"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("ack mode: %s", ackMode)
+
+	confirmShutdownTimeout, err = parseDuration("CONFIRM_SHUTDOWN_TIMEOUT", defaultConfirmShutdownTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// With publisher confirms, shutdown waits up to CONFIRM_SHUTDOWN_TIMEOUT
+	// for the outstanding ones once the grace period is over.
+	var confirmWait time.Duration
+	if confirmMode != confirmModeOff {
+		confirmWait = confirmShutdownTimeout
+	}
+	if warning := broker.ShutdownTimeoutWarning(shutdownTimeout, shutdownGracePeriod, confirmWait); warning != "" {
+		log.Print(warning)
+	}
+
+	consumeOpts, err := broker.ConsumeOptionsFromEnv(broker.ConsumeOptions{Tag: broker.DefaultConsumerTag(consumerTagPrefix), Durable: true, Prefetch: defaultPrefetchCount, ManualAck: true})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("queues %v: durable=%t auto_delete=%t exclusive=%t prefetch=%d", queues, consumeOpts.Durable, consumeOpts.AutoDelete, consumeOpts.Exclusive, consumeOpts.Prefetch)
+
+	reconnectBackoff, err = broker.BackoffFromEnv(broker.Backoff{Initial: defaultReconnectBackoff, Max: defaultReconnectMaxBackoff})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	maxMessageBytes, err = parseInt("MAX_MESSAGE_BYTES", defaultMaxMessageBytes)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if maxMessageBytes == 0 {
+		log.Fatal("invalid MAX_MESSAGE_BYTES \"0\": must be greater than zero")
+	}
+
+	expectedContentType = os.Getenv("EXPECT_CONTENT_TYPE")
+
+	messageSchema, err = broker.SchemaFromEnv()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	brokerCfg, err := broker.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if broker.CheckConfigOnly() {
+		log.Println("configuration is valid")
+		return
+	}
+
+	serveMetrics(getEnv("METRICS_PORT", defaultMetricsPort))
+
+	log.Printf("connecting to %s", brokerCfg.RedactedURL())
+	conn, ch, err := broker.Connect(brokerCfg)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	broker.NotifyState(conn, ch, setConnectionState)
+
+	msgsCh, consumerTags, err := setup(ch, queues, consumeOpts)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("consumer tags: %v", consumerTags)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	promoteCh := make(chan os.Signal, 1)
+	signal.Notify(promoteCh, syscall.SIGUSR1)
+
+	// ctx is the parent of every per-message context. It is only cancelled once
+	// the shutdown grace period elapses, aborting whatever is still in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool, err := broker.NewPool(workerCount)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("workers: %d", workerCount)
+
+	handle := newHandler(ch)
+	interrupted := false
+
 main_loop:
 	for {
 		select {
-		case msg := <-msgsCh:
-			if err := triggerIrrigators(ch, msg.Body); err != nil {
-				log.Printf("failed to trigger irrigators: %v", err)
+		case msg, ok := <-msgsCh:
+			if !ok {
+				if interrupted {
+					break main_loop
+				}
+
+				if !conn.IsClosed() {
+					log.Println("deliveries channel closed while the connection is up, reopening the channel...")
+					ch.Close()
+
+					newCh, newMsgsCh, newConsumerTags, err := reopenChannel(conn, queues, consumeOpts)
+					if err == nil {
+						ch, msgsCh, consumerTags = newCh, newMsgsCh, newConsumerTags
+						handle = newHandler(ch)
+						log.Printf("channel reopened, consumer tags: %v", consumerTags)
+						continue
+					}
+					log.Printf("failed to reopen the channel: %v", err)
+				}
+
+				log.Println("deliveries channel closed, reconnecting...")
+				conn.Close()
+
+				newConn, newCh, newMsgsCh, newConsumerTags, err := reconnect(brokerCfg, queues, consumeOpts)
+				if err != nil {
+					log.Printf("failed to reconnect: %v", err)
+					break main_loop
+				}
+				conn, ch, msgsCh, consumerTags = newConn, newCh, newMsgsCh, newConsumerTags
+				handle = newHandler(ch)
+				log.Printf("reconnected, consumer tags: %v", consumerTags)
+				continue
 			}
 
+			if err := pool.Submit(ctx, handle, msg); err != nil {
+				log.Printf("delivery %d left unhandled: %v", msg.DeliveryTag, err)
+			}
+
+		case <-promoteCh:
+			promote()
+
 		case <-c:
 			fmt.Println("interrupting...")
-			ch.Close()
-			conn.Close()
+			interrupted = true
+			if err := cancelConsumers(ch, consumerTags); err != nil {
+				log.Print(err.Error())
+				break main_loop
+			}
+			time.AfterFunc(shutdownGracePeriod, cancel)
+			broker.StartWatchdog(shutdownTimeout, operations)
+
+		case <-ctx.Done():
+			log.Printf("shutdown grace period of %s elapsed, closing with pending deliveries", shutdownGracePeriod)
 			break main_loop
 		}
 	}
+
+	pool.Close()
+
+	if confirmMode != confirmModeOff {
+		for _, p := range outstandingConfirms.waitAll(confirmShutdownTimeout) {
+			log.Printf("irrigate command to exchange \"%s\" with routing key \"%s\" was not confirmed before shutdown", p.cmd.exchange, p.cmd.key)
+		}
+	}
+
+	ch.Close()
+	conn.Close()
 }
 
-func registerConsumer(ch *amqp.Channel, queue string) (<-chan amqp.Delivery, error) {
-	q, err := ch.QueueDeclare(
-		queue,
-		true,
-		false,
-		false,
-		false,
-		nil,
+// newHandler builds the delivery handler publishing on ch. It is rebuilt after
+// a reconnect, so the workers still busy with a delivery of the old channel
+// keep the channel they started with.
+func newHandler(ch channel) broker.Handler {
+	return broker.Chain(
+		func(ctx context.Context, delivery amqp.Delivery) error {
+			err := triggerIrrigators(ctx, ch, delivery.Body)
+			if err != nil {
+				log.Printf("failed to trigger irrigators: %v", err)
+			}
+
+			return err
+		},
+		acknowledge,
+		trackInFlight,
+		broker.Trace(tracer, "triggerIrrigators"),
+		broker.Track(operations),
+		checkContentType,
+		decompress,
+		validateSchema,
 	)
+}
+
+// validateSchema drops deliveries whose decompressed body does not match the
+// MESSAGE_SCHEMA_PATH schema. Without a schema every delivery goes through.
+func validateSchema(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if messageSchema == nil {
+			return next(ctx, delivery)
+		}
+
+		if err := messageSchema.Validate(delivery.Body); err != nil {
+			droppedMessagesMetric.WithLabelValues("schema").Inc()
+			return fmt.Errorf("dropping message: %w", err)
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+// decompress gunzips the body of deliveries sent with a gzip content
+// encoding, dropping the ones that cannot be decompressed.
+func decompress(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		delivery, err := broker.Decompress(delivery, maxMessageBytes)
+		if err != nil {
+			droppedMessagesMetric.WithLabelValues("decompress_failed").Inc()
+			return fmt.Errorf("dropping message: %w", err)
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+func trackInFlight(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		inFlightMetric.Inc()
+		defer inFlightMetric.Dec()
+
+		return next(ctx, delivery)
+	}
+}
+
+// checkContentType drops deliveries whose content type does not match
+// EXPECT_CONTENT_TYPE. It does nothing when EXPECT_CONTENT_TYPE is unset.
+func checkContentType(next broker.Handler) broker.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if expectedContentType != "" && !broker.ContentTypeMatches(expectedContentType, delivery.ContentType) {
+			droppedMessagesMetric.WithLabelValues("content_type").Inc()
+			return fmt.Errorf("dropping message with content type \"%s\", expected \"%s\"", delivery.ContentType, expectedContentType)
+		}
+
+		return next(ctx, delivery)
+	}
+}
+
+// setup registers a consumer on each of queues, plus the exchanges and
+// irrigator bindings, on a freshly opened channel, both at startup and after a
+// reconnect. The deliveries of every queue are merged into one channel and
+// share the same handler.
+func setup(ch channel, queues []string, opts broker.ConsumeOptions) (<-chan amqp.Delivery, []string, error) {
+	msgsCh, tags, err := broker.ConsumeAll(ch, queues, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare a queue: %w", err)
+		return nil, nil, err
 	}
 
-	msgs, err := ch.Consume(
-		q.Name,
-		"collector",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	if confirmMode != confirmModeOff {
+		if err := ch.Confirm(false); err != nil {
+			return nil, nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+		}
+	}
+
+	if err := registerExchanges(ch); err != nil {
+		return nil, nil, err
+	}
+
+	if err := registerIrrigators(ch); err != nil {
+		return nil, nil, err
+	}
+
+	return msgsCh, tags, nil
+}
+
+func cancelConsumers(ch channel, tags []string) error {
+	for _, tag := range tags {
+		if err := ch.Cancel(tag, false); err != nil {
+			return fmt.Errorf("failed to cancel consumer \"%s\": %w", tag, err)
+		}
+	}
+
+	return nil
+}
+
+// reconnect dials RabbitMQ again once the deliveries channel closed under us
+// and runs setup on the new channel. It gives up on SIGINT/SIGTERM.
+func reconnect(cfg broker.Config, queues []string, opts broker.ConsumeOptions) (*amqp.Connection, *amqp.Channel, <-chan amqp.Delivery, []string, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, ch, err := broker.Reconnect(ctx, cfg, reconnectBackoff)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	amqpReconnectsMetric.Inc()
+	broker.NotifyState(conn, ch, setConnectionState)
+
+	msgsCh, tags, err := setup(ch, queues, opts)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return conn, ch, msgsCh, tags, nil
+}
+
+// reopenChannel opens a new channel on conn, which is still up, after the
+// broker closed the previous one (e.g. on a publish failing a precondition),
+// and registers the consumer, exchanges and bindings on it again without
+// tearing down the connection.
+func reopenChannel(conn *amqp.Connection, queues []string, opts broker.ConsumeOptions) (*amqp.Channel, <-chan amqp.Delivery, []string, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	broker.NotifyState(conn, ch, setConnectionState)
+
+	msgsCh, tags, err := setup(ch, queues, opts)
+	if err != nil {
+		ch.Close()
+		return nil, nil, nil, err
+	}
+
+	return ch, msgsCh, tags, nil
+}
+
+// validateExchanges refuses EXCHANGE_ALL, EXCHANGE_QUADRANTS and, when set,
+// FALLBACK_EXCHANGE naming the same exchange, or the exchange of one of the
+// irrigators, which gets its own exchange named after it. Each is declared
+// with its own kind and durability, so a shared name would only fail later
+// with a PRECONDITION_FAILED channel error.
+func validateExchanges(all, quadrants, fallback string, irrigators []string) error {
+	if all == quadrants {
+		return fmt.Errorf("EXCHANGE_ALL and EXCHANGE_QUADRANTS must differ, both are \"%s\"", all)
+	}
+
+	if fallback == all || fallback == quadrants {
+		return fmt.Errorf("FALLBACK_EXCHANGE \"%s\" must differ from EXCHANGE_ALL and EXCHANGE_QUADRANTS", fallback)
+	}
+
+	names := []string{all, quadrants}
+	if fallback != "" {
+		names = append(names, fallback)
+	}
+
+	for _, name := range names {
+		if slices.Contains(irrigators, name) {
+			return fmt.Errorf("exchange \"%s\" collides with the exchange of irrigator \"%s\"", name, name)
+		}
+	}
+
+	return nil
+}
+
+// parseIrrigators splits IRRIGATORS_LIST on commas, trimming each entry and
+// dropping blank ones, so values like "a-b-c, , d-e-f," are accepted. A name
+// listed twice is rejected: it would be declared twice and counted twice
+// against len(irrigators) when deciding to irrigate everything. So is a name
+// not in the "irg-<quadrant>-<point>" format registerIrrigators binds by.
+func parseIrrigators(value string) ([]string, error) {
+	var irrigators []string
+	seen := map[string]bool{}
+	for _, i := range strings.Split(value, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+
+		if seen[i] {
+			return nil, fmt.Errorf("invalid IRRIGATORS_LIST: irrigator \"%s\" is listed more than once", i)
+		}
+		if _, err := quadrantTopicKey(i); err != nil {
+			return nil, fmt.Errorf("invalid IRRIGATORS_LIST: %w", err)
+		}
+		seen[i] = true
+		irrigators = append(irrigators, i)
+	}
+
+	return irrigators, nil
+}
+
+// parseMoistureThreshold accepts a plain number or one with a trailing "%"
+// (e.g. "30%"). The sign is only stripped: "30%" means 30 on the same scale as
+// the sensors' AverageMoisture, not 0.3.
+func parseMoistureThreshold(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(value, "%"))
+
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse MOISTURE_THRESHOLD: %w", err)
+	}
+
+	return threshold, nil
+}
+
+func parseDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\": must be greater than zero", name, value)
+	}
+
+	return d, nil
+}
+
+// debugf logs only when DEBUG is enabled.
+func debugf(format string, args ...any) {
+	if debug {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+func getEnv(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return def
+}
+
+func parseInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register a consumer: %w", err)
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
 	}
 
-	return msgs, nil
+	if i < 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\": must not be negative", name, value)
+	}
+
+	return i, nil
 }
 
-func registerExchanges(ch *amqp.Channel) error {
+func parseFloat(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	if f < 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\": must not be negative", name, value)
+	}
+
+	return f, nil
+}
+
+func parseBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+func registerExchanges(ch channel) error {
 	if err := ch.ExchangeDeclare(
-		"all",
+		exchangeAll,
 		amqp.ExchangeFanout,
 		false,
 		false,
@@ -127,11 +849,11 @@ func registerExchanges(ch *amqp.Channel) error {
 		false,
 		nil,
 	); err != nil {
-		return fmt.Errorf("failed to declare exchange \"all\": %w", err)
+		return fmt.Errorf("%w \"%s\": %w", broker.ErrExchangeDeclare, exchangeAll, err)
 	}
 
 	if err := ch.ExchangeDeclare(
-		"quadrants",
+		exchangeQuadrants,
 		amqp.ExchangeTopic,
 		false,
 		false,
@@ -139,13 +861,35 @@ func registerExchanges(ch *amqp.Channel) error {
 		false,
 		nil,
 	); err != nil {
-		return fmt.Errorf("failed to declare exchange \"quadrants\": %w", err)
+		return fmt.Errorf("%w \"%s\": %w", broker.ErrExchangeDeclare, exchangeQuadrants, err)
+	}
+
+	if fallbackExchange != "" {
+		if err := ch.ExchangeDeclare(
+			fallbackExchange,
+			amqp.ExchangeFanout,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		); err != nil {
+			return fmt.Errorf("%w \"%s\": %w", broker.ErrExchangeDeclare, fallbackExchange, err)
+		}
 	}
 
 	return nil
 }
 
-func registerIrrigators(ch *amqp.Channel) error {
+// registerIrrigators declares the queue and exchange of every irrigator and
+// binds it to "all", to each of its quadrant scopes and to its own exchange.
+// A bind that failed on a transient error does not stop the other irrigators
+// from being registered, but every failure is reported, so an irrigator that
+// would silently miss commands keeps the controller from starting. A broker
+// error closes the channel, so registration stops there and reports it rather
+// than a failure with amqp.ErrClosed for every irrigator left.
+func registerIrrigators(ch channel) error {
+	var errs []error
 	for _, i := range irrigators {
 		queue, err := ch.QueueDeclare(
 			i,
@@ -156,7 +900,7 @@ func registerIrrigators(ch *amqp.Channel) error {
 			nil,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to declare queue \"%s\": %w", i, err)
+			return fmt.Errorf("%w \"%s\": %w", broker.ErrQueueDeclare, i, err)
 		}
 
 		err = ch.ExchangeDeclare(
@@ -169,115 +913,327 @@ func registerIrrigators(ch *amqp.Channel) error {
 			nil,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to declare exchange \"%s\": %w", i, err)
+			return fmt.Errorf("%w \"%s\": %w", broker.ErrExchangeDeclare, i, err)
 		}
 
-		irrigatorFields := strings.Split(i, "-")
-		if len(irrigatorFields) != 3 {
-			return fmt.Errorf("failed to parse irrigator fields: %s", irrigatorFields)
+		key, err := quadrantTopicKey(i)
+		if err != nil {
+			return err
 		}
 
-		ch.QueueBind(
-			queue.Name,
-			"",
-			"all",
-			false,
-			nil,
-		)
-
-		ch.QueueBind(
-			queue.Name,
-			irrigatorFields[1],
-			"quadrants",
-			false,
-			nil,
-		)
+		bindings := [][2]string{{"", exchangeAll}}
+		for _, scope := range quadrantScopes(key) {
+			bindings = append(bindings, [2]string{scope, exchangeQuadrants})
+		}
+		bindings = append(bindings, [2]string{i, i})
 
-		ch.QueueBind(
-			queue.Name,
-			i,
-			i,
-			false,
-			nil,
-		)
+		for _, b := range bindings {
+			if err := bindWithRetry(ch, queue.Name, b[0], b[1]); err != nil {
+				errs = append(errs, err)
+				if closesChannel(err) {
+					return errors.Join(errs...)
+				}
+			}
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func triggerIrrigators(ch *amqp.Channel, data []byte) error {
+// triggerIrrigators decides on each message by itself: "every sensor under the
+// threshold" only looks at the readings of data. With several RABBITMQ_QUEUE
+// queues, messages from different queues are never aggregated.
+func triggerIrrigators(parent context.Context, ch channel, data []byte) error {
+	if len(data) > maxMessageBytes {
+		droppedMessagesMetric.WithLabelValues("oversized").Inc()
+		return fmt.Errorf("dropping message of %d bytes, larger than MAX_MESSAGE_BYTES (%d)", len(data), maxMessageBytes)
+	}
+
 	log.Printf("Received message: %s", string(data))
 
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
+		unmarshalErrorsMetric.Inc()
 		return fmt.Errorf("failed to unmarshal message content: %w", err)
 	}
+	processedMessagesMetric.Inc()
+	recordMoisture(msg.Sensors)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(parent, publishTimeout)
 	defer cancel()
 
-	count := 0
-	sensorsUnderThreshold := map[string][]string{}
-	payload := amqp.Publishing{
-		ContentType: "text/plain",
-		Body:        []byte("irrigate"),
-	}
+	var batch confirmBatch
+	sensorsUnderThreshold, count := groupSensorsUnderThreshold(msg.Sensors)
+	deficits := locationDeficits(msg.Sensors)
+	trace.SpanFromContext(parent).SetAttributes(
+		attribute.Int("sensors.count", len(msg.Sensors)),
+		attribute.Int("sensors.under_threshold", count),
+	)
 
-	for _, sensor := range msg.Sensors {
-		if sensor.AverageMoisture <= moistureThreshold {
-			sensorsUnderThreshold[sensor.Location] = append(sensorsUnderThreshold[sensor.Location], sensor.Id)
-			count++
+	errs := []error{}
+	recovered := recoveredLocations(msg.Sensors, sensorsUnderThreshold)
+	for _, cmd := range recovered {
+		if err := publish(ctx, ch, &batch, cmd); err != nil {
+			errs = append(errs, fmt.Errorf("%w (stop) in exchange \"%s\": %w", errPublishFailed, cmd.exchange, err))
 		}
 	}
 
-	if count == len(irrigators) {
-		if err := ch.PublishWithContext(
-			ctx,
-			"all",
-			"",
-			false,
-			false,
-			payload,
-		); err != nil {
-			return fmt.Errorf("failed to publish message in exchange \"all\": %w", err)
+	if count == 0 {
+		if len(recovered) > 0 {
+			errs = append(errs, batch.wait(ctx))
+			return errors.Join(errs...)
 		}
 
-		log.Println("Message sent to exchange \"all\"")
+		noActionMessagesMetric.Inc()
+		debugf("no irrigation needed, none of the %d sensors is under the threshold", len(msg.Sensors))
 		return nil
 	}
 
-	errs := []error{}
-	for k, v := range sensorsUnderThreshold {
+	cmds, orphans := locationCommands(sensorsUnderThreshold, deficits)
+	recordDry(cmds)
+	recordDry(orphans)
+	if len(irrigators) > 0 && len(distinctTargets(cmds)) == len(irrigators) {
+		cmds = []irrigateCommand{broadcastCommand(cmds, deficits)}
+	}
+
+	for _, cmd := range cmds {
+		if err := publish(ctx, ch, &batch, cmd); err != nil {
+			errs = append(errs, fmt.Errorf("%w in exchange \"%s\": %w", errPublishFailed, cmd.exchange, err))
+		}
+	}
+
+	for _, cmd := range orphans {
+		if err := publish(ctx, ch, &batch, cmd); err != nil {
+			errs = append(errs, fmt.Errorf("%w in exchange \"%s\": %w", errPublishFailed, cmd.exchange, err))
+		} else if fallbackExchange != "" {
+			fallbackPublishesMetric.Inc()
+		}
+	}
+
+	errs = append(errs, batch.wait(ctx))
+	return errors.Join(errs...)
+}
+
+// locationCommands builds one command per location under the threshold, sent
+// to the irrigator of its single sensor or else to its quadrant, in location
+// order. The commands no irrigator is bound to are returned apart as orphans,
+// routed to FALLBACK_EXCHANGE when it is set.
+func locationCommands(grouped map[string][]string, deficits map[string]float64) (cmds, orphans []irrigateCommand) {
+	locations := make([]string, 0, len(grouped))
+	for k := range grouped {
+		locations = append(locations, k)
+	}
+	sort.Strings(locations)
+
+	for _, k := range locations {
+		v := grouped[k]
+		cmd := irrigateCommand{exchange: exchangeQuadrants, key: quadrantScope(k), locations: []string{k}, sensors: v, deficit: deficits[k]}
 		if len(v) == 1 {
 			irrigator := fmt.Sprintf("irg-%s-%s", k, v[0])
-			if err := ch.PublishWithContext(
-				ctx,
-				irrigator,
-				irrigator,
-				false,
-				false,
-				payload,
-			); err != nil {
-				errs = append(errs, fmt.Errorf("failed to publish message in exchange \"%s\": %w", irrigator, err))
+			cmd.exchange, cmd.key = irrigator, irrigator
+		}
+
+		if len(cmd.targets()) > 0 {
+			cmds = append(cmds, cmd)
+			continue
+		}
+
+		// Orphan commands go to the fallback exchange keyed by what they were
+		// meant for: the sensor Id for a single sensor, the location otherwise.
+		if fallbackExchange != "" && len(v) == 1 {
+			log.Printf("no irrigator for sensor \"%s\" in location \"%s\", routing to fallback exchange \"%s\"", v[0], k, fallbackExchange)
+			cmd.exchange, cmd.key = fallbackExchange, v[0]
+		} else if fallbackExchange != "" {
+			log.Printf("no irrigator for location \"%s\", routing to fallback exchange \"%s\"", k, fallbackExchange)
+			cmd.exchange, cmd.key = fallbackExchange, k
+		}
+		orphans = append(orphans, cmd)
+	}
+
+	return cmds, orphans
+}
+
+// distinctTargets is the set of irrigators reached by cmds.
+func distinctTargets(cmds []irrigateCommand) map[string]struct{} {
+	targets := map[string]struct{}{}
+	for _, cmd := range cmds {
+		for _, t := range cmd.targets() {
+			targets[t] = struct{}{}
+		}
+	}
+
+	return targets
+}
+
+// broadcastCommand merges cmds, which together reach every irrigator, into a
+// single command to the all exchange.
+func broadcastCommand(cmds []irrigateCommand, deficits map[string]float64) irrigateCommand {
+	var locations, sensors []string
+	for _, cmd := range cmds {
+		locations = append(locations, cmd.locations...)
+		sensors = append(sensors, cmd.sensors...)
+	}
+
+	return irrigateCommand{exchange: exchangeAll, locations: locations, sensors: sensors, deficit: maxDeficit(deficits, locations)}
+}
+
+type irrigateCommand struct {
+	exchange  string
+	key       string
+	locations []string
+	sensors   []string
+	// deficit is how far the driest triggering sensor is below the threshold.
+	deficit float64
+	// stop is set on the command sent to a location that recovered, with
+	// SEND_STOP.
+	stop bool
+}
+
+// targets lists the irrigators the command is routed to, following the
+// bindings made by registerIrrigators.
+func (cmd irrigateCommand) targets() []string {
+	switch cmd.exchange {
+	case exchangeAll:
+		return irrigators
+	case exchangeQuadrants:
+		var targets []string
+		for _, i := range irrigators {
+			if key, err := quadrantTopicKey(i); err == nil && inQuadrantScope(key, cmd.key) {
+				targets = append(targets, i)
 			}
+		}
+
+		return targets
+	default:
+		if slices.Contains(irrigators, cmd.exchange) {
+			return []string{cmd.exchange}
+		}
+
+		return nil
+	}
+}
+
+// publish sends the command's payload to its exchange with its routing key. In
+// dry-run mode the decision is only logged, so the routing logic stays the same
+// as the live path but nothing reaches the irrigators; a stop still clears the
+// dry state of its locations, as does one withheld in standby, so it is only
+// logged once. With publisher confirms
+// enabled the confirmation is either awaited right away or queued in batch.
+func publish(ctx context.Context, ch channel, batch *confirmBatch, cmd irrigateCommand) error {
+	if dryRun {
+		log.Printf("[dry-run] would send message to exchange \"%s\" with routing key \"%s\" for sensors %v", cmd.exchange, cmd.key, cmd.sensors)
+		recordStopped(cmd)
+		return nil
+	}
+
+	if standby.Load() {
+		log.Printf("[standby] withholding message to exchange \"%s\" with routing key \"%s\" for sensors %v", cmd.exchange, cmd.key, cmd.sensors)
+		recordStopped(cmd)
+		return nil
+	}
+
+	if !cmd.stop && coolingDown(cmd) {
+		irrigateSuppressedMetric.Inc()
+		log.Printf("suppressing message to exchange \"%s\" with routing key \"%s\" for sensors %v: within IRRIGATE_COOLDOWN (%s) of the last command", cmd.exchange, cmd.key, cmd.sensors, irrigateCooldown)
+		return nil
+	}
+
+	payload, err := buildPayload(cmd)
+	if err != nil {
+		recordCommandResult(cmd, commandResultFailure)
+		return err
+	}
+
+	defer operations.Start(fmt.Sprintf("publish to exchange \"%s\" with routing key \"%s\"", cmd.exchange, cmd.key))()
+
+	if publishLimiter != nil {
+		if err := publishLimiter.wait(ctx); err != nil {
+			recordCommandResult(cmd, commandResultFailure)
+			return err
+		}
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		cmd.exchange,
+		cmd.key,
+		false,
+		false,
+		payload,
+	)
+	if err != nil {
+		recordCommandResult(cmd, commandResultFailure)
+		return err
+	}
+
+	log.Printf("Message sent to exchange \"%s\" with routing key \"%s\" for sensors %v", cmd.exchange, cmd.key, cmd.sensors)
+
+	if confirm == nil {
+		recordCommanded(cmd)
+		recordStopped(cmd)
+		recordIrrigated(cmd)
+		return nil
+	}
+
+	p := pendingConfirm{cmd: cmd, confirm: confirm}
+	outstandingConfirms.track(p)
+	if confirmMode == confirmModeBatch {
+		batch.add(p)
+		return nil
+	}
 
-			log.Printf("Message sent to exchange \"%s\"", irrigator)
+	return p.wait(ctx)
+}
+
+// locationDeficits returns, for each location with sensors under the moisture
+// threshold, the deficit of its driest sensor.
+func locationDeficits(sensors []Sensor) map[string]float64 {
+	deficits := map[string]float64{}
+	for _, sensor := range sensors {
+		if !underThreshold(sensor) {
 			continue
 		}
-		
-		if err := ch.PublishWithContext(
-			ctx,
-			"quadrants",
-			k,
-			false,
-			false,
-			payload,
-		); err != nil {
-			errs = append(errs, fmt.Errorf("failed to publish message in exchange \"%s\": %w", k, err))
+
+		deficits[sensor.Location] = max(deficits[sensor.Location], moistureThreshold-sensor.AverageMoisture, 0)
+	}
+
+	return deficits
+}
+
+func maxDeficit(deficits map[string]float64, locations []string) float64 {
+	var deficit float64
+	for _, location := range locations {
+		deficit = max(deficit, deficits[location])
+	}
+
+	return deficit
+}
+
+// groupSensorsUnderThreshold returns the Ids of the sensors under the moisture
+// threshold grouped by location, along with the number of distinct sensors
+// found. Duplicated readings of the same sensor are counted only once.
+func groupSensorsUnderThreshold(sensors []Sensor) (map[string][]string, int) {
+	seen := map[string]map[string]struct{}{}
+	for _, sensor := range sensors {
+		if !underThreshold(sensor) {
+			continue
 		}
 
-		log.Printf("Message sent to exchange \"quadrants\" with routing key \"%s\"", k)
+		if seen[sensor.Location] == nil {
+			seen[sensor.Location] = map[string]struct{}{}
+		}
+		seen[sensor.Location][sensor.Id] = struct{}{}
 	}
 
-	return errors.Join(errs...)
+	count := 0
+	grouped := make(map[string][]string, len(seen))
+	for location, ids := range seen {
+		for id := range ids {
+			grouped[location] = append(grouped[location], id)
+		}
+		sort.Strings(grouped[location])
+		count += len(ids)
+	}
+
+	return grouped, count
 }
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+var testIrrigators = []string{"irg-q1-001", "irg-q2-001", "irg-q3-001", "irg-q4-001"}
+
+// setupController resets the decision state and configuration triggerIrrigators
+// depends on to the defaults, with testIrrigators bound and a threshold of 30.
+// The clock is frozen at start.
+func setupController(t *testing.T, start time.Time) *time.Time {
+	t.Helper()
+
+	irrigators = append([]string(nil), testIrrigators...)
+	moistureThreshold = 30
+	moistureHysteresis = 0
+	publishTimeout = defaultPublishTimeout
+	maxMessageBytes = defaultMaxMessageBytes
+	payloadFormat = payloadFormatJSON
+	confirmMode = confirmModeOff
+	fallbackExchange = ""
+	irrigateCooldown = 0
+	sendStop = false
+	dryRun = false
+	ackMode = ackModeAlways
+	publishLimiter = nil
+	messageSchema = nil
+	expectedContentType = ""
+	standby.Store(false)
+
+	irrigating = map[string]bool{}
+	dryLocations = map[string]stopRoute{}
+	lastCommanded = map[string]time.Time{}
+
+	clock := start
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	return &clock
+}
+
+// sensorMessage is the body of a message with one sensor per location=moisture
+// pair, each with Id "001".
+func sensorMessage(t *testing.T, readings ...string) []byte {
+	t.Helper()
+
+	var msg Message
+	for _, reading := range readings {
+		location, moisture, _ := strings.Cut(reading, "=")
+		var m float64
+		if _, err := fmt.Sscan(moisture, &m); err != nil {
+			t.Fatal(err)
+		}
+		msg.Sensors = append(msg.Sensors, Sensor{Id: "001", Location: location, AverageMoisture: m})
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func trigger(t *testing.T, ch *fakeChannel, readings ...string) error {
+	t.Helper()
+
+	return triggerIrrigators(context.Background(), ch, sensorMessage(t, readings...))
+}
+
+// routes lists where each publish went, as "exchange/key".
+func routes(published []publishing) []string {
+	routes := make([]string, 0, len(published))
+	for _, p := range published {
+		routes = append(routes, p.exchange+"/"+p.key)
+	}
+
+	return routes
+}
+
+// action is the action of a JSON irrigate command.
+func action(t *testing.T, p publishing) string {
+	t.Helper()
+
+	var payload struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(p.msg.Body, &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", p.msg.Body, err)
+	}
+
+	return payload.Action
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+func TestTriggerIrrigatorsSingleSensor(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10", "q2=50"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := ch.takePublished()
+	if want := []string{"irg-q1-001/irg-q1-001"}; fmt.Sprint(routes(got)) != fmt.Sprint(want) {
+		t.Fatalf("published to %v, want %v", routes(got), want)
+	}
+
+	if a := action(t, got[0]); a != "irrigate" {
+		t.Errorf("action = %q, want irrigate", a)
+	}
+}
+
+func TestTriggerIrrigatorsNothingDry(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	before := counterValue(t, noActionMessagesMetric)
+	if err := trigger(t, ch, "q1=50", "q2=80"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ch.takePublished(); len(got) != 0 {
+		t.Errorf("published to %v, want nothing", routes(got))
+	}
+
+	if got := counterValue(t, noActionMessagesMetric) - before; got != 1 {
+		t.Errorf("no-action messages grew by %g, want 1", got)
+	}
+}
+
+func TestTriggerIrrigatorsBroadcast(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q4=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[all/]" {
+		t.Errorf("published to %v, want a single publish to all", got)
+	}
+}
+
+func TestTriggerIrrigatorsPublishError(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+	ch.publishErr = amqp.ErrClosed
+
+	if err := trigger(t, ch, "q1=10"); err == nil {
+		t.Fatal("publish error was not returned")
+	}
+}
+
+// TestConsumeDeliveries feeds synthetic deliveries through the consumer set up
+// by setup and the handler the controller runs, checking the topology, the
+// commands published and how each delivery was settled.
+func TestConsumeDeliveries(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	msgs, tags, err := setup(ch, []string{"sensors"}, broker.ConsumeOptions{Tag: "controller", ManualAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(tags) != "[controller]" {
+		t.Errorf("consumer tags = %v", tags)
+	}
+
+	if !strings.Contains(strings.Join(ch.bindings, "\n"), "quadrants/q1 -> irg-q1-001") {
+		t.Errorf("irg-q1-001 is not bound to its quadrant: %v", ch.bindings)
+	}
+
+	handle := newHandler(ch)
+	ack := &fakeAcknowledger{}
+	bodies := [][]byte{sensorMessage(t, "q2=10"), []byte("not json")}
+
+	go func() {
+		for i, body := range bodies {
+			ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i + 1), Body: body}
+		}
+		close(ch.deliveries)
+	}()
+
+	for delivery := range msgs {
+		handle(context.Background(), delivery)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q2-001/irg-q2-001]" {
+		t.Errorf("published to %v", got)
+	}
+
+	if acks, nacks := ack.settled(); acks != 2 || nacks != 0 {
+		t.Errorf("got %d acks and %d nacks, want every delivery acked", acks, nacks)
+	}
+
+	if err := cancelConsumers(ch, tags); err != nil || fmt.Sprint(ch.cancelled) != "[controller]" {
+		t.Errorf("cancelConsumers = %v, cancelled %v", err, ch.cancelled)
+	}
+}
+
+func TestGroupSensorsUnderThresholdDeduplicates(t *testing.T) {
+	setupController(t, time.Now())
+
+	grouped, count := groupSensorsUnderThreshold([]Sensor{
+		{Id: "002", Location: "q1", AverageMoisture: 10},
+		{Id: "001", Location: "q1", AverageMoisture: 20},
+		{Id: "002", Location: "q1", AverageMoisture: 15},
+		{Id: "001", Location: "q2", AverageMoisture: 50},
+	})
+
+	if fmt.Sprint(grouped) != "map[q1:[001 002]]" || count != 2 {
+		t.Errorf("grouped %v (%d sensors), want q1 with 001 and 002", grouped, count)
+	}
+}
+
+// TestTriggerIrrigatorsDuplicateSensor checks a sensor reported twice still
+// counts as a single sensor, routed to its own irrigator.
+func TestTriggerIrrigatorsDuplicateSensor(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10", "q1=15"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001]" {
+		t.Errorf("published to %v, want irg-q1-001 alone", got)
+	}
+}
+
+func TestTriggerIrrigatorsDryRun(t *testing.T) {
+	setupController(t, time.Now())
+	dryRun = true
+	ch := newFakeChannel()
+
+	before := counterValue(t, irrigatorCommandsMetric.WithLabelValues("irg-q1-001", commandResultSuccess))
+	if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q4=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ch.takePublished(); len(got) != 0 {
+		t.Errorf("dry run published to %v", routes(got))
+	}
+
+	if got := counterValue(t, irrigatorCommandsMetric.WithLabelValues("irg-q1-001", commandResultSuccess)) - before; got != 0 {
+		t.Errorf("dry run counted %g irrigate commands", got)
+	}
+}
+
+// TestTriggerIrrigatorsCancelled checks the publishes of a message use a
+// context derived from the parent, so a shutdown cancels them.
+func TestTriggerIrrigatorsCancelled(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := triggerIrrigators(ctx, ch, sensorMessage(t, "q1=10"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("triggerIrrigators = %v, want context.Canceled", err)
+	}
+
+	if got := ch.takePublished(); len(got) != 0 {
+		t.Errorf("published to %v after the cancel", routes(got))
+	}
+}
+
+func TestParseMoistureThreshold(t *testing.T) {
+	for value, want := range map[string]float64{"30": 30, "30%": 30, " 42.5 % ": 42.5, "0%": 0} {
+		if got, err := parseMoistureThreshold(value); err != nil || got != want {
+			t.Errorf("parseMoistureThreshold(%q) = %g, %v, want %g", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "%", "thirty", "30%%"} {
+		if _, err := parseMoistureThreshold(value); err == nil {
+			t.Errorf("parseMoistureThreshold(%q) was accepted", value)
+		}
+	}
+}
+
+func TestParseIrrigators(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"irg-q1-001,irg-q2-001", []string{"irg-q1-001", "irg-q2-001"}},
+		{"irg-q1-001, irg-q2-001,", []string{"irg-q1-001", "irg-q2-001"}},
+		{" irg-q1-001 , , irg-q2-001 ,,", []string{"irg-q1-001", "irg-q2-001"}},
+		{",\tirg-q1-001\n", []string{"irg-q1-001"}},
+		{" , ,", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := parseIrrigators(tt.value)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseIrrigators(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseIrrigators("irg-q1-001, irg-q2"); err == nil {
+		t.Error("an entry without three fields was accepted")
+	}
+}
+
+func TestSensorUnmarshalJSON(t *testing.T) {
+	for _, body := range []string{
+		`{"Id":"001","Location":"q1","AverageMoisture":42.5}`,
+		`{"Id":"001","Location":"q1","AverageMoisture":"42.5"}`,
+		`{"Id":"001","Location":"q1","AverageMoisture":" 42.5 "}`,
+	} {
+		var sensor Sensor
+		if err := json.Unmarshal([]byte(body), &sensor); err != nil {
+			t.Errorf("%s: %v", body, err)
+			continue
+		}
+
+		if sensor.Id != "001" || sensor.Location != "q1" || sensor.AverageMoisture != 42.5 {
+			t.Errorf("%s decodes as %+v", body, sensor)
+		}
+	}
+
+	for _, body := range []string{`{"Id":"001"}`, `{"Id":"001","AverageMoisture":null}`} {
+		var sensor Sensor
+		if err := json.Unmarshal([]byte(body), &sensor); err != nil || sensor.AverageMoisture != 0 {
+			t.Errorf("%s decodes as %+v, %v, want a zero moisture", body, sensor, err)
+		}
+	}
+
+	for _, body := range []string{`{"AverageMoisture":"dry"}`, `{"AverageMoisture":""}`, `{"AverageMoisture":true}`} {
+		var sensor Sensor
+		if err := json.Unmarshal([]byte(body), &sensor); err == nil {
+			t.Errorf("%s was decoded as %+v", body, sensor)
+		}
+	}
+}
+
+func TestParseIrrigatorsDuplicates(t *testing.T) {
+	for _, value := range []string{
+		"irg-q1-001,irg-q1-001",
+		"irg-q1-001, irg-q2-001 , irg-q1-001",
+		" irg-q1-001 ,irg-q1-001",
+	} {
+		if got, err := parseIrrigators(value); err == nil || !strings.Contains(err.Error(), `"irg-q1-001" is listed more than once`) {
+			t.Errorf("parseIrrigators(%q) = %q, %v, want the duplicate rejected", value, got, err)
+		}
+	}
+
+	// Distinct irrigators of the same quadrant are not duplicates.
+	if got, err := parseIrrigators("irg-q1-001, irg-q1-002"); err != nil || len(got) != 2 {
+		t.Errorf("parseIrrigators of two irrigators of q1 = %q, %v", got, err)
+	}
+}
+
+// TestCheckContentType checks a delivery of the expected content type reaches
+// the handler, one of another content type is dropped and counted, and every
+// delivery goes through while EXPECT_CONTENT_TYPE is unset.
+func TestCheckContentType(t *testing.T) {
+	setupController(t, time.Now())
+	t.Cleanup(func() { expectedContentType = "" })
+	dropped := droppedMessagesMetric.WithLabelValues("content_type")
+	before := counterValue(t, dropped)
+
+	var handled int
+	handle := checkContentType(func(ctx context.Context, delivery amqp.Delivery) error {
+		handled++
+		return nil
+	})
+
+	tests := []struct {
+		expected, contentType string
+		pass                  bool
+	}{
+		{"", "text/plain", true},
+		{"", "", true},
+		{"application/json", "application/json", true},
+		{"application/json", "application/json; charset=utf-8", true},
+		{"application/json", "text/plain", false},
+		{"application/json", "", false},
+	}
+
+	for _, tt := range tests {
+		expectedContentType = tt.expected
+		handled = 0
+		err := handle(context.Background(), amqp.Delivery{ContentType: tt.contentType})
+
+		if pass := err == nil && handled == 1; pass != tt.pass {
+			t.Errorf("EXPECT_CONTENT_TYPE %q, content type %q: handled %d times, err %v, want passed %t", tt.expected, tt.contentType, handled, err, tt.pass)
+		}
+	}
+
+	if got := counterValue(t, dropped) - before; got != 2 {
+		t.Errorf("content_type drops went up by %g, want 2", got)
+	}
+}
+
+// TestSetupAfterChannelClose simulates the broker closing the channel while
+// the connection stays up: the deliveries of the first channel stop, and the
+// setup run on the reopened channel registers the consumer, exchanges and
+// bindings again, with the new handler publishing on the new channel only.
+func TestSetupAfterChannelClose(t *testing.T) {
+	setupController(t, time.Now())
+	opts := broker.ConsumeOptions{Tag: "controller", ManualAck: true}
+
+	first := newFakeChannel()
+	msgs, _, err := setup(first, []string{"sensors"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(first.deliveries)
+	if _, ok := <-msgs; ok {
+		t.Fatal("a delivery was received from the closed channel")
+	}
+
+	reopened := newFakeChannel()
+	msgs, tags, err := setup(reopened, []string{"sensors"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(tags) != "[controller]" {
+		t.Errorf("consumer tags on the reopened channel = %v", tags)
+	}
+	if fmt.Sprint(reopened.bindings) != fmt.Sprint(first.bindings) {
+		t.Errorf("the reopened channel has bindings %v, want %v", reopened.bindings, first.bindings)
+	}
+
+	handle := newHandler(reopened)
+	ack := &fakeAcknowledger{}
+	go func() {
+		reopened.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: sensorMessage(t, "q2=10")}
+		close(reopened.deliveries)
+	}()
+	for delivery := range msgs {
+		handle(context.Background(), delivery)
+	}
+
+	if got := routes(reopened.takePublished()); fmt.Sprint(got) != "[irg-q2-001/irg-q2-001]" {
+		t.Errorf("published to %v on the reopened channel", got)
+	}
+	if got := first.takePublished(); len(got) != 0 {
+		t.Errorf("published to %v on the closed channel", routes(got))
+	}
+	if acks, _ := ack.settled(); acks != 1 {
+		t.Errorf("got %d acks on the reopened channel, want 1", acks)
+	}
+}
+
+// TestConsumeSeveralQueues sets the controller up on two queues and checks
+// each is consumed under its own tag, both feed the same handler, and the
+// messages of different queues are decided on separately: three quadrants dry
+// in one message and the fourth in another do not make a broadcast.
+func TestConsumeSeveralQueues(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	msgs, tags, err := setup(ch, []string{"sensors-north", "sensors-south"}, broker.ConsumeOptions{Tag: "controller", ManualAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(tags) != "[controller-sensors-north controller-sensors-south]" {
+		t.Errorf("consumer tags = %v", tags)
+	}
+	if want := "[controller-sensors-north <- sensors-north controller-sensors-south <- sensors-south]"; fmt.Sprint(ch.consumed) != want {
+		t.Errorf("consumed %v, want %s", ch.consumed, want)
+	}
+
+	handle := newHandler(ch)
+	ack := &fakeAcknowledger{}
+	go func() {
+		for _, body := range [][]byte{sensorMessage(t, "q1=10", "q2=10", "q3=10"), sensorMessage(t, "q4=10")} {
+			ch.deliveries <- amqp.Delivery{Acknowledger: ack, Body: body}
+		}
+		close(ch.deliveries)
+	}()
+
+	for delivery := range msgs {
+		handle(context.Background(), delivery)
+	}
+
+	got := routes(ch.takePublished())
+	slices.Sort(got)
+	if want := "[irg-q1-001/irg-q1-001 irg-q2-001/irg-q2-001 irg-q3-001/irg-q3-001 irg-q4-001/irg-q4-001]"; fmt.Sprint(got) != want {
+		t.Errorf("published to %v, want %s", got, want)
+	}
+
+	if acks, _ := ack.settled(); acks != 2 {
+		t.Errorf("got %d acks, want both deliveries acked", acks)
+	}
+
+	if err := cancelConsumers(ch, tags); err != nil || fmt.Sprint(ch.cancelled) != fmt.Sprint(tags) {
+		t.Errorf("cancelConsumers = %v, cancelled %v", err, ch.cancelled)
+	}
+}
+
+func TestMessageSensorsKey(t *testing.T) {
+	for _, body := range []string{
+		`{"sensors":[{"Id":"001","Location":"q1","AverageMoisture":10}]}`,
+		`{"Sensors":[{"Id":"001","Location":"q1","AverageMoisture":10}]}`,
+	} {
+		var msg Message
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+
+		if len(msg.Sensors) != 1 || msg.Sensors[0].Location != "q1" || msg.Sensors[0].AverageMoisture != 10 {
+			t.Errorf("%s decodes as %+v", body, msg)
+		}
+	}
+
+	body, err := json.Marshal(Message{Sensors: []Sensor{{Id: "001"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), `{"sensors":`) {
+		t.Errorf("a Message encodes as %s, want the lowercase sensors key", body)
+	}
+}
+
+// TestTriggerIrrigatorsLowercaseSensors checks a payload with the lowercase
+// key producers send is acted on rather than read as an empty batch.
+func TestTriggerIrrigatorsLowercaseSensors(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	body := []byte(`{"sensors":[{"Id":"001","Location":"q1","AverageMoisture":10}]}`)
+	if err := triggerIrrigators(context.Background(), ch, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001]" {
+		t.Errorf("published to %v, want irg-q1-001", got)
+	}
+}
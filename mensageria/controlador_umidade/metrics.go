@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"broker"
+)
+
+const (
+	metricsNamespace   = "moisture_controller"
+	defaultMetricsPort = "2112"
+
+	commandResultSuccess = "success"
+	commandResultFailure = "failure"
+)
+
+var (
+	now = time.Now
+
+	registry = prometheus.NewRegistry()
+
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// reservedLabels are the labels the controller metrics already use, so
+	// EXTRA_LABELS may not use them.
+	reservedLabels = []string{"location", "irrigator", "result", "reason", "version", "commit", "go_version"}
+
+	locationLastIrrigatedMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "location_last_irrigated_timestamp",
+			Help:      "unix timestamp of the last irrigate command successfully published for the location",
+			Namespace: metricsNamespace,
+		},
+		[]string{"location"},
+	)
+
+	locationMoistureMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "location_moisture",
+			Help:      "mean AverageMoisture of the sensors of the location in the last message that included it",
+			Namespace: metricsNamespace,
+		},
+		[]string{"location"},
+	)
+
+	irrigatorCommandsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "irrigator_commands_total",
+			Help:      "number of irrigate commands routed to each irrigator, by result",
+			Namespace: metricsNamespace,
+		},
+		[]string{"irrigator", "result"},
+	)
+
+	fallbackPublishesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "fallback_publishes_total",
+			Help:      "number of irrigate commands routed to FALLBACK_EXCHANGE because no irrigator matched their sensor or location",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	irrigateSuppressedMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "irrigate_suppressed_total",
+			Help:      "number of irrigate commands suppressed because their irrigators were within IRRIGATE_COOLDOWN of the last command",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	roleActiveMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "role_active",
+			Help:      "1 when the controller is active and publishing, 0 while it is a standby",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	droppedMessagesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "messages_dropped_total",
+			Help:      "number of messages dropped before any irrigate command was computed",
+			Namespace: metricsNamespace,
+		},
+		[]string{"reason"},
+	)
+
+	processedMessagesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "messages_processed_total",
+			Help:      "number of messages decoded and evaluated against the threshold",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	unmarshalErrorsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "unmarshal_errors_total",
+			Help:      "number of messages whose body could not be decoded as sensor readings",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	noActionMessagesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "messages_no_action_total",
+			Help:      "number of messages handled without publishing any irrigate command because no sensor was under the threshold",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	inFlightMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "messages_in_flight",
+			Help:      "number of deliveries handed to a worker and not yet fully processed",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	amqpConnectedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "amqp_connected",
+			Help:      "1 while the connection to RabbitMQ is open, 0 otherwise",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	amqpChannelOpenMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "amqp_channel_open",
+			Help:      "1 while the AMQP channel is open, 0 otherwise",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	// rabbitmqConnectedMetric carries no namespace so a single alert rule covers
+	// every service.
+	rabbitmqConnectedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rabbitmq_connected",
+			Help: "1 while the service holds a live connection to RabbitMQ, 0 otherwise",
+		},
+	)
+
+	amqpReconnectsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "amqp_reconnects_total",
+			Help:      "number of times the controller reconnected to RabbitMQ",
+			Namespace: metricsNamespace,
+		},
+	)
+
+	buildInfoMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "build_info",
+			Help:      "always 1, labeled with the version, commit and Go version the controller was built with",
+			Namespace: metricsNamespace,
+		},
+		[]string{"version", "commit", "go_version"},
+	)
+)
+
+// registerMetrics registers every metric with registry, adding extraLabels to
+// each of them as constant labels.
+func registerMetrics(extraLabels prometheus.Labels) {
+	buildInfoMetric.WithLabelValues(broker.Version, broker.Commit, broker.GoVersion()).Set(1)
+
+	// The Go runtime and process metrics describe this process, so they are
+	// registered without EXTRA_LABELS, under their usual names.
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	prometheus.WrapRegistererWith(extraLabels, registry).MustRegister(locationLastIrrigatedMetric, locationMoistureMetric, irrigatorCommandsMetric, fallbackPublishesMetric, irrigateSuppressedMetric, roleActiveMetric, droppedMessagesMetric, processedMessagesMetric, unmarshalErrorsMetric, noActionMessagesMetric, inFlightMetric, amqpConnectedMetric, amqpChannelOpenMetric, rabbitmqConnectedMetric, amqpReconnectsMetric, buildInfoMetric)
+}
+
+// parseExtraLabels reads EXTRA_LABELS, a comma separated list of name=value
+// pairs. Names must be valid Prometheus label names and must not clash with the
+// labels the controller already uses.
+func parseExtraLabels(spec string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid extra label \"%s\": expected name=value", entry)
+		}
+
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid extra label \"%s\": \"%s\" is not a valid label name", entry, name)
+		}
+
+		if slices.Contains(reservedLabels, name) {
+			return nil, fmt.Errorf("invalid extra label \"%s\": \"%s\" is already used by the controller", entry, name)
+		}
+
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("invalid extra label \"%s\": duplicate label \"%s\"", entry, name)
+		}
+
+		labels[name] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
+}
+
+// newMetricsMux serves /metrics and, when PROMOTE_TOKEN is set, /promote.
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if promoteToken != "" {
+		mux.HandleFunc("/promote", handlePromote)
+	}
+
+	return mux
+}
+
+func serveMetrics(port string) {
+	mux := newMetricsMux()
+
+	go func() {
+		log.Printf("serving metrics on :%s/metrics", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+}
+
+func setConnectionState(state broker.State) {
+	amqpConnectedMetric.Set(boolToFloat(state.Connected))
+	rabbitmqConnectedMetric.Set(boolToFloat(state.Connected))
+	amqpChannelOpenMetric.Set(boolToFloat(state.ChannelOpen))
+}
+
+func boolToFloat(v bool) float64 {
+	if v {
+		return 1
+	}
+
+	return 0
+}
+
+// recordIrrigated is called once an irrigate command is known to have reached
+// the broker (published, and confirmed when confirms are enabled). A stop
+// command does not move the last irrigated time of its locations.
+func recordIrrigated(cmd irrigateCommand) {
+	if !cmd.stop {
+		ts := float64(now().Unix())
+		for _, location := range cmd.locations {
+			locationLastIrrigatedMetric.WithLabelValues(location).Set(ts)
+		}
+	}
+	recordCommandResult(cmd, commandResultSuccess)
+}
+
+// recordMoisture sets location_moisture for every location in sensors.
+// Locations absent from the message keep their last value rather than being
+// cleared: a message usually carries the sensors of a single location, so
+// clearing would blank every other location between their own messages.
+func recordMoisture(sensors []Sensor) {
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	for _, sensor := range sensors {
+		sums[sensor.Location] += sensor.AverageMoisture
+		counts[sensor.Location]++
+	}
+
+	for location, sum := range sums {
+		locationMoistureMetric.WithLabelValues(location).Set(sum / float64(counts[location]))
+	}
+}
+
+func recordCommandResult(cmd irrigateCommand, result string) {
+	for _, irrigator := range cmd.targets() {
+		irrigatorCommandsMetric.WithLabelValues(irrigator, result).Inc()
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"broker"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetGauge().GetValue()
+}
+
+func TestLocationLastIrrigated(t *testing.T) {
+	clock := setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	sendStop = true
+	payloadFormat = payloadFormatJSON
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	irrigatedAt := clock.Unix()
+	if got := gaugeValue(t, locationLastIrrigatedMetric.WithLabelValues("q1")); got != float64(irrigatedAt) {
+		t.Errorf("location_last_irrigated_timestamp = %g, want %d", got, irrigatedAt)
+	}
+
+	// The stop sent once q1 recovers does not count as an irrigation.
+	*clock = clock.Add(time.Minute)
+	if err := trigger(t, ch, "q1=50"); err != nil {
+		t.Fatal(err)
+	}
+	if got := gaugeValue(t, locationLastIrrigatedMetric.WithLabelValues("q1")); got != float64(irrigatedAt) {
+		t.Errorf("location_last_irrigated_timestamp = %g after the stop, want %d", got, irrigatedAt)
+	}
+}
+
+// TestLocationLastIrrigatedOnFailure checks a failed publish leaves the last
+// irrigated time alone.
+func TestLocationLastIrrigatedOnFailure(t *testing.T) {
+	clock := setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q2=10"); err != nil {
+		t.Fatal(err)
+	}
+	irrigatedAt := clock.Unix()
+
+	*clock = clock.Add(time.Minute)
+	ch.publishErr = errPublishFailed
+	trigger(t, ch, "q2=10")
+
+	if got := gaugeValue(t, locationLastIrrigatedMetric.WithLabelValues("q2")); got != float64(irrigatedAt) {
+		t.Errorf("location_last_irrigated_timestamp = %g after a failed publish, want %d", got, irrigatedAt)
+	}
+}
+
+// TestSetConnectionState drives the controller through a connect, a channel
+// closed under a live connection and a disconnect, and checks the gauges
+// follow each transition.
+func TestSetConnectionState(t *testing.T) {
+	t.Cleanup(func() { setConnectionState(broker.State{}) })
+
+	tests := []struct {
+		name  string
+		state broker.State
+		want  [3]float64
+	}{
+		{"connected", broker.State{Connected: true, ChannelOpen: true}, [3]float64{1, 1, 1}},
+		{"channel closed", broker.State{Connected: true, ChannelOpen: false}, [3]float64{1, 1, 0}},
+		{"disconnected", broker.State{}, [3]float64{0, 0, 0}},
+		{"reconnected", broker.State{Connected: true, ChannelOpen: true}, [3]float64{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		setConnectionState(tt.state)
+
+		got := [3]float64{
+			gaugeValue(t, amqpConnectedMetric),
+			gaugeValue(t, rabbitmqConnectedMetric),
+			gaugeValue(t, amqpChannelOpenMetric),
+		}
+		if got != tt.want {
+			t.Errorf("%s: amqp_connected, rabbitmq_connected, amqp_channel_open = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRabbitMQConnectedIsServed checks rabbitmq_connected is served on
+// /metrics without the controller namespace, so one alert rule covers both
+// services, and follows a disconnect and the reconnect after it.
+func TestRabbitMQConnectedIsServed(t *testing.T) {
+	saved := registry
+	registry = prometheus.NewRegistry()
+	t.Cleanup(func() {
+		registry = saved
+		setConnectionState(broker.State{})
+	})
+	registerMetrics(prometheus.Labels{})
+
+	server := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	t.Cleanup(server.Close)
+
+	for _, state := range []broker.State{{Connected: true, ChannelOpen: true}, {}, {Connected: true, ChannelOpen: true}} {
+		setConnectionState(state)
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("\nrabbitmq_connected %g\n", boolToFloat(state.Connected))
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics does not serve %q with %+v", strings.TrimSpace(want), state)
+		}
+	}
+}
+
+// TestIrrigatorCommandsPerResult publishes to one irrigator, then fails the
+// publish to another, and checks each irrigator counts its own outcome.
+func TestIrrigatorCommandsPerResult(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	ch := newFakeChannel()
+
+	counters := map[string]prometheus.Counter{}
+	before := map[string]float64{}
+	for _, irrigator := range []string{"irg-q1-001", "irg-q2-001"} {
+		for _, result := range []string{commandResultSuccess, commandResultFailure} {
+			key := irrigator + " " + result
+			counters[key] = irrigatorCommandsMetric.WithLabelValues(irrigator, result)
+			before[key] = counterValue(t, counters[key])
+		}
+	}
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.publishErr = amqp.ErrClosed
+	if err := trigger(t, ch, "q2=10"); err == nil {
+		t.Fatal("the failed publish was not returned")
+	}
+
+	want := map[string]float64{
+		"irg-q1-001 " + commandResultSuccess: 1,
+		"irg-q1-001 " + commandResultFailure: 0,
+		"irg-q2-001 " + commandResultSuccess: 0,
+		"irg-q2-001 " + commandResultFailure: 1,
+	}
+	for key, counter := range counters {
+		if got := counterValue(t, counter) - before[key]; got != want[key] {
+			t.Errorf("irrigator_commands_total{%s} went up by %g, want %g", key, got, want[key])
+		}
+	}
+}
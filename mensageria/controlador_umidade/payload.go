@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	payloadFormatText = "text"
+	payloadFormatJSON = "json"
+
+	defaultIrrigationDuration    = time.Minute
+	defaultIrrigationMinDuration = 10 * time.Second
+	defaultIrrigationMaxDuration = 10 * time.Minute
+)
+
+var (
+	payloadFormat      = payloadFormatText
+	irrigationDuration = defaultIrrigationDuration
+
+	// irrigateContentType is IRRIGATE_CONTENT_TYPE. When empty, publishes use
+	// the content type of the PAYLOAD_FORMAT: text/plain or application/json.
+	irrigateContentType string
+
+	// irrigationDurationPerPoint is zero unless the duration should scale with
+	// the moisture deficit, in which case irrigationDuration is ignored.
+	irrigationDurationPerPoint time.Duration
+	irrigationMinDuration      = defaultIrrigationMinDuration
+	irrigationMaxDuration      = defaultIrrigationMaxDuration
+)
+
+// irrigatePayload is the body sent to irrigators with PAYLOAD_FORMAT=json.
+type irrigatePayload struct {
+	Action    string   `json:"action"`
+	DurationS int      `json:"duration_s"`
+	Sensors   []string `json:"sensors"`
+}
+
+func parsePayloadFormat(value string) (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(value)); format {
+	case "", payloadFormatText:
+		return payloadFormatText, nil
+	case payloadFormatJSON:
+		return payloadFormatJSON, nil
+	default:
+		return "", fmt.Errorf("invalid PAYLOAD_FORMAT \"%s\": expected %s or %s", value, payloadFormatText, payloadFormatJSON)
+	}
+}
+
+// parseContentType validates IRRIGATE_CONTENT_TYPE, which may carry
+// parameters such as "text/plain; charset=utf-8".
+func parseContentType(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	if _, _, err := mime.ParseMediaType(value); err != nil {
+		return "", fmt.Errorf("invalid IRRIGATE_CONTENT_TYPE \"%s\": %w", value, err)
+	}
+
+	return value, nil
+}
+
+// contentTypeFor is the content type every irrigate publish carries, whether
+// it goes to "all", to "quadrants" or to a single irrigator.
+func contentTypeFor(format string) string {
+	switch {
+	case irrigateContentType != "":
+		return irrigateContentType
+	case format == payloadFormatJSON:
+		return "application/json"
+	default:
+		return "text/plain"
+	}
+}
+
+// buildPayload renders cmd for the irrigators: the legacy text/plain
+// "irrigate" body, or a JSON command carrying the irrigation duration and the
+// sensors that triggered it. A stop command has the "stop" action with no
+// duration; SEND_STOP is refused with the text payload.
+func buildPayload(cmd irrigateCommand) (amqp.Publishing, error) {
+	action := "irrigate"
+	if cmd.stop {
+		action = "stop"
+	}
+
+	if payloadFormat == payloadFormatText {
+		return amqp.Publishing{
+			ContentType: contentTypeFor(payloadFormat),
+			Body:        []byte(action),
+		}, nil
+	}
+
+	payload := irrigatePayload{Action: action, Sensors: cmd.sensors}
+	if !cmd.stop {
+		payload.DurationS = int(math.Round(irrigationDurationFor(cmd.deficit).Seconds()))
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("failed to marshal irrigate payload: %w", err)
+	}
+
+	return amqp.Publishing{
+		ContentType: contentTypeFor(payloadFormat),
+		Body:        body,
+	}, nil
+}
+
+// irrigationDurationFor is IRRIGATION_DURATION, or, with
+// IRRIGATION_DURATION_PER_POINT set, the deficit times that rate clamped to
+// IRRIGATION_MIN_DURATION and IRRIGATION_MAX_DURATION.
+func irrigationDurationFor(deficit float64) time.Duration {
+	if irrigationDurationPerPoint == 0 {
+		return irrigationDuration
+	}
+
+	d := time.Duration(deficit * float64(irrigationDurationPerPoint))
+	return min(max(d, irrigationMinDuration), irrigationMaxDuration)
+}
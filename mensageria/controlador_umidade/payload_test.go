@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// scaleDuration sets up the duration to scale with the deficit at perPoint,
+// clamped to [minimum, maximum], for the rest of the test.
+func scaleDuration(t *testing.T, perPoint, minimum, maximum time.Duration) {
+	t.Helper()
+
+	irrigationDurationPerPoint, irrigationMinDuration, irrigationMaxDuration = perPoint, minimum, maximum
+	t.Cleanup(func() {
+		irrigationDurationPerPoint = 0
+		irrigationMinDuration, irrigationMaxDuration = defaultIrrigationMinDuration, defaultIrrigationMaxDuration
+	})
+}
+
+// durationS is the duration_s of a JSON irrigate command.
+func durationS(t *testing.T, p publishing) int {
+	t.Helper()
+
+	var payload irrigatePayload
+	if err := json.Unmarshal(p.msg.Body, &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", p.msg.Body, err)
+	}
+
+	return payload.DurationS
+}
+
+func TestIrrigationDurationFor(t *testing.T) {
+	if got := irrigationDurationFor(25); got != irrigationDuration {
+		t.Errorf("without a rate per point the duration is %s, want IRRIGATION_DURATION (%s)", got, irrigationDuration)
+	}
+
+	scaleDuration(t, 10*time.Second, time.Minute, 5*time.Minute)
+
+	tests := []struct {
+		deficit float64
+		want    time.Duration
+	}{
+		{0, time.Minute},
+		{5, time.Minute},
+		{6, time.Minute},
+		{12.5, 125 * time.Second},
+		{30, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := irrigationDurationFor(tt.deficit); got != tt.want {
+			t.Errorf("irrigationDurationFor(%g) = %s, want %s", tt.deficit, got, tt.want)
+		}
+	}
+}
+
+// TestIrrigationDurationDriestSensor checks the command of a location with
+// several sensors under the threshold carries the deficit of the driest one,
+// and a broadcast the deficit of the driest location.
+func TestIrrigationDurationDriestSensor(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	scaleDuration(t, 10*time.Second, time.Second, time.Hour)
+	ch := newFakeChannel()
+
+	sensors := []Sensor{
+		{Id: "001", Location: "q3", AverageMoisture: 25},
+		{Id: "002", Location: "q3", AverageMoisture: 10},
+		{Id: "003", Location: "q3", AverageMoisture: 40},
+	}
+	if err := triggerSensors(t, ch, sensors); err != nil {
+		t.Fatal(err)
+	}
+
+	published := ch.takePublished()
+	if len(published) != 1 {
+		t.Fatalf("published to %v, want a single command for q3", routes(published))
+	}
+	if got := durationS(t, published[0]); got != 200 {
+		t.Errorf("duration_s = %d, want 200 for the deficit of 20 of the driest sensor", got)
+	}
+
+	if err := trigger(t, ch, "q1=10", "q2=20", "q3=25", "q4=28"); err != nil {
+		t.Fatal(err)
+	}
+
+	published = ch.takePublished()
+	if len(published) != 1 || published[0].exchange != exchangeAll {
+		t.Fatalf("published to %v, want a single publish to all", routes(published))
+	}
+	if got := durationS(t, published[0]); got != 200 {
+		t.Errorf("broadcast duration_s = %d, want 200 for the deficit of 20 of q1", got)
+	}
+}
+
+func TestParseContentType(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                                 "",
+		" application/json ":               "application/json",
+		"text/plain; charset=utf-8":        "text/plain; charset=utf-8",
+		"application/vnd.irrigate.v1+json": "application/vnd.irrigate.v1+json",
+	} {
+		if got, err := parseContentType(value); err != nil || got != want {
+			t.Errorf("parseContentType(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"text/", "not a type", "text/plain; charset"} {
+		if _, err := parseContentType(value); err == nil {
+			t.Errorf("parseContentType(%q) was accepted", value)
+		}
+	}
+}
+
+// TestIrrigateContentType checks every publish, whether to a single
+// irrigator, to a quadrant or to all of them, carries the same content type:
+// IRRIGATE_CONTENT_TYPE when set, or the one of the PAYLOAD_FORMAT.
+func TestIrrigateContentType(t *testing.T) {
+	tests := []struct {
+		format, contentType string
+		want                string
+	}{
+		{payloadFormatText, "", "text/plain"},
+		{payloadFormatJSON, "", "application/json"},
+		{payloadFormatText, "text/plain; charset=utf-8", "text/plain; charset=utf-8"},
+		{payloadFormatJSON, "application/vnd.irrigate.v1+json", "application/vnd.irrigate.v1+json"},
+	}
+
+	for _, tt := range tests {
+		setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		payloadFormat = tt.format
+		irrigateContentType = tt.contentType
+		t.Cleanup(func() { irrigateContentType = "" })
+		ch := newFakeChannel()
+
+		if err := trigger(t, ch, "q1=10"); err != nil {
+			t.Fatal(err)
+		}
+		quadrant := []Sensor{
+			{Id: "001", Location: "q3", AverageMoisture: 10},
+			{Id: "002", Location: "q3", AverageMoisture: 10},
+		}
+		if err := triggerSensors(t, ch, quadrant); err != nil {
+			t.Fatal(err)
+		}
+		if err := trigger(t, ch, "q1=10", "q2=10", "q3=10", "q4=10"); err != nil {
+			t.Fatal(err)
+		}
+
+		published := ch.takePublished()
+		if got := routes(published); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001 quadrants/q3 all/]" {
+			t.Fatalf("published to %v, want an irrigator, a quadrant and all", got)
+		}
+
+		for _, p := range published {
+			if p.msg.ContentType != tt.want {
+				t.Errorf("%s payload, IRRIGATE_CONTENT_TYPE %q: publish to %s/%s has content type %q, want %q", tt.format, tt.contentType, p.exchange, p.key, p.msg.ContentType, tt.want)
+			}
+		}
+	}
+}
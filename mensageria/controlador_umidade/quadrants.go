@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quadrantTopicKey derives the key an irrigator is bound with on the
+// "quadrants" topic exchange from the quadrant in its name, the middle field
+// of "irg-<quadrant>-<point>". Quadrants may be hierarchical, with words
+// separated by dots: "irg-north.east.1-3" has the key "north.east.1". A plain
+// quadrant such as "irg-q1-3" keeps the single word key "q1".
+func quadrantTopicKey(irrigator string) (string, error) {
+	fields := strings.Split(irrigator, "-")
+	if len(fields) != 3 {
+		return "", fmt.Errorf("failed to parse irrigator fields: %s", fields)
+	}
+
+	for _, word := range strings.Split(fields[1], ".") {
+		if word == "" || strings.ContainsAny(word, "*#") {
+			return "", fmt.Errorf("invalid quadrant \"%s\" in irrigator \"%s\": words must be non-empty and must not contain topic wildcards", fields[1], irrigator)
+		}
+	}
+
+	return fields[1], nil
+}
+
+// quadrantScopes lists every scope a quadrant key belongs to, from the widest
+// to the key itself: "north.east.1" gives "north", "north.east" and
+// "north.east.1". Irrigators are bound with each of them, so a publish to a
+// parent scope reaches every irrigator under it.
+func quadrantScopes(key string) []string {
+	words := strings.Split(key, ".")
+	scopes := make([]string, 0, len(words))
+	for i := range words {
+		scopes = append(scopes, strings.Join(words[:i+1], "."))
+	}
+
+	return scopes
+}
+
+// quadrantScope turns a location into the routing key published to the
+// "quadrants" exchange. Since routing keys are matched literally, the binding
+// style "north.#" is accepted as a synonym of the scope "north".
+func quadrantScope(location string) string {
+	return strings.TrimSuffix(location, ".#")
+}
+
+// inQuadrantScope reports whether the quadrant key falls under scope, either
+// because they are equal or because scope is one of its parents.
+func inQuadrantScope(key, scope string) bool {
+	return key == scope || strings.HasPrefix(key, scope+".")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQuadrantTopicKey(t *testing.T) {
+	for irrigator, want := range map[string]string{
+		"irg-q1-3":           "q1",
+		"irg-north.east.1-3": "north.east.1",
+	} {
+		if got, err := quadrantTopicKey(irrigator); err != nil || got != want {
+			t.Errorf("quadrantTopicKey(%q) = %q, %v, want %q", irrigator, got, err, want)
+		}
+	}
+
+	for _, irrigator := range []string{"irg-q1", "irg-q1-3-4", "irg-north..east-3", "irg-north.*-3", "irg-#-3", "irg--3"} {
+		if got, err := quadrantTopicKey(irrigator); err == nil {
+			t.Errorf("quadrantTopicKey(%q) = %q, want an error", irrigator, got)
+		}
+	}
+}
+
+func TestQuadrantScopes(t *testing.T) {
+	if got := quadrantScopes("north.east.1"); fmt.Sprint(got) != "[north north.east north.east.1]" {
+		t.Errorf("quadrantScopes(north.east.1) = %v", got)
+	}
+
+	if got := quadrantScopes("q1"); fmt.Sprint(got) != "[q1]" {
+		t.Errorf("quadrantScopes(q1) = %v", got)
+	}
+}
+
+func TestInQuadrantScope(t *testing.T) {
+	tests := []struct {
+		key, scope string
+		want       bool
+	}{
+		{"north.east.1", "north.east.1", true},
+		{"north.east.1", "north.east", true},
+		{"north.east.1", "north", true},
+		{"north.east.1", "north.west", false},
+		{"northern.1", "north", false},
+		{"north", "north.east", false},
+	}
+
+	for _, tt := range tests {
+		if got := inQuadrantScope(tt.key, tt.scope); got != tt.want {
+			t.Errorf("inQuadrantScope(%q, %q) = %t, want %t", tt.key, tt.scope, got, tt.want)
+		}
+	}
+
+	if got := quadrantScope("north.#"); got != "north" {
+		t.Errorf("quadrantScope(north.#) = %q, want north", got)
+	}
+}
+
+// TestRegisterIrrigatorsHierarchicalBindings checks an irrigator with a dotted
+// quadrant is bound on the quadrants exchange with every scope of its key.
+func TestRegisterIrrigatorsHierarchicalBindings(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	irrigators = []string{"irg-north.east.1-001"}
+	ch := newFakeChannel()
+
+	if err := registerIrrigators(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"all/ -> irg-north.east.1-001",
+		"quadrants/north -> irg-north.east.1-001",
+		"quadrants/north.east -> irg-north.east.1-001",
+		"quadrants/north.east.1 -> irg-north.east.1-001",
+		"irg-north.east.1-001/irg-north.east.1-001 -> irg-north.east.1-001",
+	} {
+		if !slices.Contains(ch.bindings, want) {
+			t.Errorf("missing binding %s: %v", want, ch.bindings)
+		}
+	}
+}
+
+// TestTriggerIrrigatorsParentScope checks sensors of a parent scope are
+// irrigated with a single publish to that scope, reaching every irrigator
+// under it.
+func TestTriggerIrrigatorsParentScope(t *testing.T) {
+	setupController(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	irrigators = []string{"irg-north.east.1-001", "irg-north.west.2-001", "irg-south.1-001"}
+	ch := newFakeChannel()
+
+	for _, location := range []string{"north", "north.#"} {
+		sensors := []Sensor{
+			{Id: "001", Location: location, AverageMoisture: 10},
+			{Id: "002", Location: location, AverageMoisture: 10},
+		}
+		if err := triggerSensors(t, ch, sensors); err != nil {
+			t.Fatal(err)
+		}
+
+		published := ch.takePublished()
+		if got := routes(published); fmt.Sprint(got) != "[quadrants/north]" {
+			t.Fatalf("location %s published to %v, want quadrants/north", location, got)
+		}
+
+		cmd := irrigateCommand{exchange: exchangeQuadrants, key: published[0].key}
+		if got := cmd.targets(); fmt.Sprint(got) != "[irg-north.east.1-001 irg-north.west.2-001]" {
+			t.Errorf("a publish to north reaches %v", got)
+		}
+	}
+}
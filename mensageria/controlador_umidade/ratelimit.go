@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errRateLimitDeadline = errors.New("publish rate limit wait would exceed the context deadline")
+
+// tokenBucket is a global outbound publish limiter allowing rate publishes per
+// second, with a burst of a single publish.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate float64, now func() time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: 1,
+		last:   now(),
+		now:    now,
+	}
+}
+
+// reserve takes a token and returns how long the caller has to wait before
+// the token is actually available.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = min(1, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) release() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// wait blocks until a publish is allowed. It never waits past the deadline of
+// ctx: when the wait would exceed it the token is given back right away.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	delay := b.reserve()
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && b.now().Add(delay).After(deadline) {
+		b.release()
+		return errRateLimitDeadline
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.release()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := newTokenBucket(2, func() time.Time { return clock })
+
+	if d := b.reserve(); d != 0 {
+		t.Errorf("first publish waits %s, want the burst of one to go through", d)
+	}
+	if d := b.reserve(); d != 500*time.Millisecond {
+		t.Errorf("second publish waits %s, want 500ms at 2/s", d)
+	}
+	if d := b.reserve(); d != time.Second {
+		t.Errorf("third publish waits %s, want 1s", d)
+	}
+
+	// Two seconds later the debt is paid and a single token is back, however
+	// long the bucket was idle.
+	clock = clock.Add(10 * time.Second)
+	if d := b.reserve(); d != 0 {
+		t.Errorf("publish after idling waits %s, want 0", d)
+	}
+	if d := b.reserve(); d != 500*time.Millisecond {
+		t.Errorf("burst after idling went past one: second publish waits %s", d)
+	}
+}
+
+// TestTokenBucketWaitGivesBackOnDeadline checks a wait that would outlast the
+// context fails right away and does not keep its token.
+func TestTokenBucketWaitGivesBackOnDeadline(t *testing.T) {
+	b := newTokenBucket(0.1, time.Now)
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := b.wait(ctx); !errors.Is(err, errRateLimitDeadline) {
+		t.Errorf("wait = %v, want errRateLimitDeadline", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < -0.01 {
+		t.Errorf("tokens = %g after giving up, want the token given back", b.tokens)
+	}
+}
+
+func TestTokenBucketWaits(t *testing.T) {
+	b := newTokenBucket(50, time.Now)
+
+	began := time.Now()
+	for range 3 {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(began); elapsed < 35*time.Millisecond {
+		t.Errorf("3 publishes at 50/s took %s, want about 40ms", elapsed)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	roleActive  = "active"
+	roleStandby = "standby"
+)
+
+// standby is set while the controller runs as a warm standby: it keeps
+// consuming and computing irrigate commands but does not publish them until
+// promoted.
+var standby atomic.Bool
+
+// promoteToken is PROMOTE_TOKEN, the bearer token a POST to /promote must carry.
+// The endpoint shares the metrics port, which anyone scraping can reach, so it
+// is only served when the token is set; SIGUSR1 promotes either way.
+var promoteToken string
+
+func parseRole(value string) (string, error) {
+	switch role := strings.ToLower(strings.TrimSpace(value)); role {
+	case "", roleActive:
+		return roleActive, nil
+	case roleStandby:
+		return roleStandby, nil
+	default:
+		return "", fmt.Errorf("invalid ROLE \"%s\": expected %s or %s", value, roleActive, roleStandby)
+	}
+}
+
+func setStandby(v bool) {
+	standby.Store(v)
+	if v {
+		roleActiveMetric.Set(0)
+	} else {
+		roleActiveMetric.Set(1)
+	}
+}
+
+// promote switches a standby controller to active. Promoting an already active
+// controller is a no-op.
+func promote() {
+	if standby.CompareAndSwap(true, false) {
+		roleActiveMetric.Set(1)
+		log.Println("promoted to active, irrigate commands will now be published")
+	}
+}
+
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !promoteAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	promote()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promoteAuthorized reports whether r carries promoteToken as its bearer
+// token, compared in constant time.
+func promoteAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || promoteToken == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(promoteToken)) == 1
+}
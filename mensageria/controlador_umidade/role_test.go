@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRole(t *testing.T) {
+	for value, want := range map[string]string{"": roleActive, "active": roleActive, " Standby ": roleStandby} {
+		if got, err := parseRole(value); err != nil || got != want {
+			t.Errorf("parseRole(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := parseRole("primary"); err == nil {
+		t.Error("parseRole accepted \"primary\"")
+	}
+}
+
+// TestStandbyWithholdsUntilPromoted checks a standby controller publishes
+// nothing, and that a POST to the promote handler makes it publish.
+func TestStandbyWithholdsUntilPromoted(t *testing.T) {
+	setupController(t, time.Now())
+	setStandby(true)
+	t.Cleanup(func() { setStandby(false) })
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.takePublished(); len(got) != 0 {
+		t.Errorf("standby published to %v", routes(got))
+	}
+	if got := gaugeValue(t, roleActiveMetric); got != 0 {
+		t.Errorf("role_active = %g in standby, want 0", got)
+	}
+
+	usePromoteToken(t, "s3cr3t")
+	rec := httptest.NewRecorder()
+	handlePromote(rec, promoteRequest(http.MethodGet, "s3cr3t"))
+	if rec.Code != http.StatusMethodNotAllowed || !standby.Load() {
+		t.Errorf("GET /promote answered %d and promoted: %t, want 405 and still standby", rec.Code, !standby.Load())
+	}
+
+	rec = httptest.NewRecorder()
+	handlePromote(rec, promoteRequest(http.MethodPost, "s3cr3t"))
+	if rec.Code != http.StatusNoContent || standby.Load() {
+		t.Fatalf("POST /promote answered %d, standby %t, want 204 and active", rec.Code, standby.Load())
+	}
+	if got := gaugeValue(t, roleActiveMetric); got != 1 {
+		t.Errorf("role_active = %g once promoted, want 1", got)
+	}
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := routes(ch.takePublished()); len(got) != 1 {
+		t.Errorf("promoted controller published to %v, want irg-q1-001", got)
+	}
+}
+
+func usePromoteToken(t *testing.T, token string) {
+	t.Helper()
+
+	promoteToken = token
+	t.Cleanup(func() { promoteToken = "" })
+}
+
+// promoteRequest is a request to /promote with token as its bearer token, or
+// without credentials when token is empty.
+func promoteRequest(method, token string) *http.Request {
+	r := httptest.NewRequest(method, "/promote", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r
+}
+
+// TestPromoteRequiresToken checks a POST to /promote without PROMOTE_TOKEN as
+// its bearer token is refused and leaves the controller in standby.
+func TestPromoteRequiresToken(t *testing.T) {
+	setStandby(true)
+	t.Cleanup(func() { setStandby(false) })
+	usePromoteToken(t, "s3cr3t")
+
+	for _, token := range []string{"", "wrong", "s3cr3t-and-more"} {
+		rec := httptest.NewRecorder()
+		handlePromote(rec, promoteRequest(http.MethodPost, token))
+		if rec.Code != http.StatusUnauthorized || !standby.Load() {
+			t.Errorf("POST /promote with token %q answered %d and promoted: %t, want 401 and still standby", token, rec.Code, !standby.Load())
+		}
+	}
+
+	r := promoteRequest(http.MethodPost, "")
+	r.SetBasicAuth("admin", "s3cr3t")
+	rec := httptest.NewRecorder()
+	handlePromote(rec, r)
+	if rec.Code != http.StatusUnauthorized || !standby.Load() {
+		t.Errorf("POST /promote with basic auth answered %d, want 401", rec.Code)
+	}
+}
+
+// TestPromoteDisabledWithoutToken checks /promote is not served on the metrics
+// port unless PROMOTE_TOKEN is set.
+func TestPromoteDisabledWithoutToken(t *testing.T) {
+	setStandby(true)
+	t.Cleanup(func() { setStandby(false) })
+
+	server := httptest.NewServer(newMetricsMux())
+	t.Cleanup(server.Close)
+
+	resp, err := http.Post(server.URL+"/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound || !standby.Load() {
+		t.Errorf("POST /promote without PROMOTE_TOKEN answered %d and promoted: %t, want 404 and still standby", resp.StatusCode, !standby.Load())
+	}
+}
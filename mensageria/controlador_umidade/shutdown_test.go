@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"broker"
+)
+
+// TestDefaultShutdownBudget checks the default grace period plus the wait for
+// outstanding confirms fits within the default SHUTDOWN_TIMEOUT.
+func TestDefaultShutdownBudget(t *testing.T) {
+	if warning := broker.ShutdownTimeoutWarning(defaultShutdownTimeout, defaultShutdownGracePeriod, defaultConfirmShutdownTimeout); warning != "" {
+		t.Error(warning)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// sendStop is SEND_STOP. When set, a location that was under the threshold
+// and has recovered is sent a "stop" command, so irrigators do not have to
+// rely on their own timeout.
+var sendStop bool
+
+// stopRoute is where the irrigate command of a dry location was routed: the
+// irrigator of its single sensor, its quadrant or FALLBACK_EXCHANGE.
+type stopRoute struct {
+	exchange string
+	key      string
+}
+
+// dryLocations holds the locations whose last message had a sensor under the
+// threshold, with the route of their irrigate command, guarded by
+// dryLocationsMu since workers handle messages concurrently. Like the
+// hysteresis state it lives in memory only: a location that was dry before a
+// restart is not sent a stop when it recovers.
+var (
+	dryLocations   = map[string]stopRoute{}
+	dryLocationsMu sync.Mutex
+)
+
+// validateSendStop refuses SEND_STOP with the text payload: a legacy irrigator
+// irrigates on any text/plain body, so a "stop" would start it instead.
+func validateSendStop(enabled bool, format string) error {
+	if enabled && format != payloadFormatJSON {
+		return fmt.Errorf("SEND_STOP requires PAYLOAD_FORMAT=%s: irrigators of the %s payload irrigate on any message", payloadFormatJSON, format)
+	}
+
+	return nil
+}
+
+// recoveredLocations returns a stop command for every location of sensors that
+// is dry and no longer in under, the locations still under the threshold,
+// routed like the irrigate command that started it, in location order. The
+// location stays dry until recordStopped, so a stop that failed is sent again
+// with the next message.
+func recoveredLocations(sensors []Sensor, under map[string][]string) []irrigateCommand {
+	if !sendStop {
+		return nil
+	}
+
+	reported := map[string][]string{}
+	for _, sensor := range sensors {
+		if _, ok := under[sensor.Location]; !ok {
+			reported[sensor.Location] = append(reported[sensor.Location], sensor.Id)
+		}
+	}
+
+	dryLocationsMu.Lock()
+	defer dryLocationsMu.Unlock()
+
+	var stops []irrigateCommand
+	for location, ids := range reported {
+		route, ok := dryLocations[location]
+		if !ok {
+			continue
+		}
+
+		sort.Strings(ids)
+		stops = append(stops, irrigateCommand{exchange: route.exchange, key: route.key, locations: []string{location}, sensors: ids, stop: true})
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].locations[0] < stops[j].locations[0] })
+
+	return stops
+}
+
+// recordDry marks the location of each of cmds as dry, remembering where its
+// irrigate command was routed for the stop to follow the same route.
+func recordDry(cmds []irrigateCommand) {
+	if !sendStop {
+		return
+	}
+
+	dryLocationsMu.Lock()
+	defer dryLocationsMu.Unlock()
+
+	for _, cmd := range cmds {
+		for _, location := range cmd.locations {
+			dryLocations[location] = stopRoute{exchange: cmd.exchange, key: cmd.key}
+		}
+	}
+}
+
+// recordStopped clears the dry state of the locations of a stop command. It is
+// called next to recordIrrigated, once the stop is known to have reached the
+// broker, or as soon as it is logged in dry-run or standby.
+func recordStopped(cmd irrigateCommand) {
+	if !cmd.stop {
+		return
+	}
+
+	dryLocationsMu.Lock()
+	defer dryLocationsMu.Unlock()
+
+	for _, location := range cmd.locations {
+		delete(dryLocations, location)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestValidateSendStop(t *testing.T) {
+	if err := validateSendStop(true, payloadFormatText); err == nil {
+		t.Error("SEND_STOP was accepted with the text payload")
+	}
+
+	if err := validateSendStop(true, payloadFormatJSON); err != nil {
+		t.Errorf("SEND_STOP with the JSON payload: %v", err)
+	}
+
+	if err := validateSendStop(false, payloadFormatText); err != nil {
+		t.Errorf("the text payload without SEND_STOP: %v", err)
+	}
+}
+
+// TestSendStopFollowsTheStartRoute checks the stop of a location that recovered
+// is sent where its irrigate command went, and only once.
+func TestSendStopFollowsTheStartRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		dry, wet []Sensor
+		route    string
+	}{
+		{"irrigator", []Sensor{{Id: "001", Location: "q1", AverageMoisture: 10}}, []Sensor{{Id: "001", Location: "q1", AverageMoisture: 50}}, "irg-q1-001/irg-q1-001"},
+		{"quadrant", []Sensor{{Id: "001", Location: "q1", AverageMoisture: 10}, {Id: "002", Location: "q1", AverageMoisture: 20}}, []Sensor{{Id: "001", Location: "q1", AverageMoisture: 50}, {Id: "002", Location: "q1", AverageMoisture: 60}}, "quadrants/q1"},
+		{"fallback", []Sensor{{Id: "001", Location: "q5", AverageMoisture: 10}}, []Sensor{{Id: "001", Location: "q5", AverageMoisture: 50}}, "fallback/001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupController(t, time.Now())
+			sendStop = true
+			fallbackExchange = "fallback"
+			ch := newFakeChannel()
+
+			if err := triggerSensors(t, ch, tt.dry); err != nil {
+				t.Fatal(err)
+			}
+			if got := routes(ch.takePublished()); fmt.Sprint(got) != fmt.Sprint([]string{tt.route}) {
+				t.Fatalf("irrigate published to %v, want %s", got, tt.route)
+			}
+
+			if err := triggerSensors(t, ch, tt.wet); err != nil {
+				t.Fatal(err)
+			}
+			got := ch.takePublished()
+			if fmt.Sprint(routes(got)) != fmt.Sprint([]string{tt.route}) {
+				t.Fatalf("stop published to %v, want %s", routes(got), tt.route)
+			}
+			if a := action(t, got[0]); a != "stop" {
+				t.Errorf("action = %q, want stop", a)
+			}
+
+			if err := triggerSensors(t, ch, tt.wet); err != nil {
+				t.Fatal(err)
+			}
+			if got := ch.takePublished(); len(got) != 0 {
+				t.Errorf("a location already stopped was sent %v", routes(got))
+			}
+		})
+	}
+}
+
+// TestSendStopRetriesAFailedStop checks a location stays dry until its stop is
+// published.
+func TestSendStopRetriesAFailedStop(t *testing.T) {
+	setupController(t, time.Now())
+	sendStop = true
+	ch := newFakeChannel()
+
+	if err := trigger(t, ch, "q1=10"); err != nil {
+		t.Fatal(err)
+	}
+	ch.takePublished()
+
+	ch.publishErr = amqp.ErrClosed
+	if err := trigger(t, ch, "q1=50"); err == nil {
+		t.Fatal("the failed stop was not reported")
+	}
+
+	ch.publishErr = nil
+	if err := trigger(t, ch, "q1=50"); err != nil {
+		t.Fatal(err)
+	}
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001]" {
+		t.Errorf("stop retried to %v, want irg-q1-001", got)
+	}
+}
+
+// TestSendStopWithheld checks a stop logged in dry-run or withheld in standby
+// still clears the dry state of its location, so later readings of the
+// recovered location do not log it again.
+func TestSendStopWithheld(t *testing.T) {
+	for _, mode := range []string{"dry-run", "standby"} {
+		t.Run(mode, func(t *testing.T) {
+			setupController(t, time.Now())
+			sendStop = true
+			dryRun = mode == "dry-run"
+			standby.Store(mode == "standby")
+			t.Cleanup(func() { standby.Store(false) })
+			ch := newFakeChannel()
+
+			var out bytes.Buffer
+			log.SetOutput(&out)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			for _, reading := range []string{"q1=10", "q1=50", "q1=50", "q1=60"} {
+				if err := trigger(t, ch, reading); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := strings.Count(out.String(), "["+mode+"]"); got != 2 {
+				t.Errorf("logged %d withheld commands, want the irrigate and a single stop:\n%s", got, out.String())
+			}
+			if _, ok := dryLocations["q1"]; ok {
+				t.Error("q1 is still dry after its stop")
+			}
+			if got := ch.takePublished(); len(got) != 0 {
+				t.Errorf("published %v", routes(got))
+			}
+		})
+	}
+}
+
+func TestSendStopDisabled(t *testing.T) {
+	setupController(t, time.Now())
+	ch := newFakeChannel()
+
+	for _, reading := range []string{"q1=10", "q1=50"} {
+		if err := trigger(t, ch, reading); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := routes(ch.takePublished()); fmt.Sprint(got) != "[irg-q1-001/irg-q1-001]" {
+		t.Errorf("published to %v, want only the irrigate command", got)
+	}
+}
+
+func triggerSensors(t *testing.T, ch *fakeChannel, sensors []Sensor) error {
+	t.Helper()
+
+	body, err := json.Marshal(Message{Sensors: sensors})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return triggerIrrigators(context.Background(), ch, body)
+}